@@ -0,0 +1,46 @@
+package panel
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditRule is a rule of the node whose hits are rejected and reported.
+type AuditRule struct {
+	Id      int    `json:"id"`
+	Type    string `json:"type"` // domain, matched as a regex, or protocol as sniffed, e.g. bittorrent
+	Pattern string `json:"pattern"`
+}
+
+// AuditEvent is a connection of a user that hit an audit rule or a block route.
+type AuditEvent struct {
+	Type   string `json:"type"` // rule or route, telling what RuleID refers to
+	UID    int    `json:"uid"`
+	RuleID int    `json:"rule_id"`
+	Target string `json:"target"`
+	Time   int64  `json:"time"`
+}
+
+// AuditPanel is implemented by panels that take audit events.
+type AuditPanel interface {
+	ReportAuditEvents(events []AuditEvent) error
+}
+
+var _ AuditPanel = (*Client)(nil)
+
+// ReportAuditEvents reports the audit rule and block route hits of the node.
+func (c *Client) ReportAuditEvents(events []AuditEvent) (err error) {
+	defer func(start time.Time) { c.observe("ReportAuditEvents", start, err) }(time.Now())
+	const path = "/api/v1/server/UniProxy/audit"
+	r, err := c.client.R().
+		SetBody(map[string][]AuditEvent{"events": events}).
+		ForceContentType("application/json").
+		Post(path)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode() >= 400 {
+		return fmt.Errorf("report audit events error: status code %d", r.StatusCode())
+	}
+	return nil
+}
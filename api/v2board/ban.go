@@ -0,0 +1,54 @@
+package panel
+
+import (
+	"encoding/json/v2"
+	"fmt"
+	"time"
+)
+
+// BanListPanel is implemented by panels that can hand out a list of banned ips.
+type BanListPanel interface {
+	GetBanList() ([]BannedIP, error)
+}
+
+var _ BanListPanel = (*Client)(nil)
+
+// BannedIP is an ip or cidr the panel bans on the node.
+type BannedIP struct {
+	IP       string `json:"ip"`
+	ExpireAt int64  `json:"expire_at"` // unix time, 0 never expires
+	Reason   string `json:"reason"`
+}
+
+type banListBody struct {
+	Bans []BannedIP `json:"bans"`
+}
+
+// GetBanList fetches the banned ips of the node. It returns nil when the
+// list did not change.
+func (c *Client) GetBanList() (bans []BannedIP, err error) {
+	defer func(start time.Time) { c.observe("GetBanList", start, err) }(time.Now())
+	const path = "/api/v1/server/UniProxy/banlist"
+	r, err := c.client.R().
+		SetHeader("If-None-Match", c.banEtag).
+		ForceContentType("application/json").
+		Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode() == 304 {
+		return nil, nil
+	}
+	if r.StatusCode() >= 400 {
+		return nil, fmt.Errorf("status code %d", r.StatusCode())
+	}
+	body := &banListBody{}
+	if err := json.Unmarshal(r.Body(), body); err != nil {
+		return nil, fmt.Errorf("decode ban list error: %s", err)
+	}
+	c.banEtag = r.Header().Get("ETag")
+	if body.Bans == nil {
+		body.Bans = []BannedIP{}
+	}
+	return body.Bans, nil
+}
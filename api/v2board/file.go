@@ -0,0 +1,292 @@
+package panel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json/v2"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/wyx2685/v2node/conf"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	_ Panel      = (*FileClient)(nil)
+	_ WatchPanel = (*FileClient)(nil)
+)
+
+// FileClient is the Panel for running a node without a panel. The node and
+// users are read from local files, which are watched for changes, and
+// reported traffic is appended to a local file.
+type FileClient struct {
+	NodeId      int
+	NodeFile    string
+	UserFile    string
+	TrafficFile string
+	hashLock    sync.Mutex // guards nodeHash and userHash, pulls run from the tasks and the watcher
+	nodeHash    string
+	userHash    string
+	watcher     *fsnotify.Watcher // nil if watching failed, the files are then read on every pull
+	changed     chan struct{}
+	nodeDirty   atomic.Bool
+	userDirty   atomic.Bool
+}
+
+func NewFileClient(c *conf.NodeConfig) (*FileClient, error) {
+	if c.NodeFile == "" || c.UserFile == "" {
+		return nil, fmt.Errorf("file api needs NodeFile and UserFile")
+	}
+	trafficFile := c.TrafficFile
+	if trafficFile == "" {
+		trafficFile = filepath.Join(filepath.Dir(c.NodeFile), "traffic_"+strconv.Itoa(c.NodeID)+".jsonl")
+	}
+	client := &FileClient{
+		NodeId:      c.NodeID,
+		NodeFile:    filepath.Clean(c.NodeFile),
+		UserFile:    filepath.Clean(c.UserFile),
+		TrafficFile: trafficFile,
+		changed:     make(chan struct{}, 1),
+	}
+	client.nodeDirty.Store(true)
+	client.userDirty.Store(true)
+	if err := client.watch(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"node_file": client.NodeFile,
+			"user_file": client.UserFile,
+			"err":       err,
+		}).Warn("Watch files failed, reading them on every pull")
+	}
+	return client, nil
+}
+
+// watch watches the directories of the node and user files, so a file
+// replaced by rename is seen as well as one written in place.
+func (c *FileClient) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("new watcher error: %s", err)
+	}
+	for _, dir := range []string{filepath.Dir(c.NodeFile), filepath.Dir(c.UserFile)} {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return fmt.Errorf("watch dir error: %s", err)
+		}
+	}
+	c.watcher = w
+	go func() {
+		defer close(c.changed)
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if e.Has(fsnotify.Chmod) {
+					continue
+				}
+				switch filepath.Clean(e.Name) {
+				case c.NodeFile:
+					c.nodeDirty.Store(true)
+				case c.UserFile:
+					c.userDirty.Store(true)
+				default:
+					continue
+				}
+				select {
+				case c.changed <- struct{}{}:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logrus.WithField("err", err).Warn("File watcher error")
+			}
+		}
+	}()
+	return nil
+}
+
+// Changed implements WatchPanel.
+func (c *FileClient) Changed() <-chan struct{} {
+	return c.changed
+}
+
+// Close implements WatchPanel.
+func (c *FileClient) Close() error {
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.Close()
+}
+
+// dirty reports whether a file has to be read, clearing its flag.
+func (c *FileClient) dirty(flag *atomic.Bool) bool {
+	return c.watcher == nil || flag.Swap(false)
+}
+
+// readFile returns the content of a json or yaml file as json, with the hash of the raw file.
+func readFile(path string) ([]byte, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(b)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v any
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, "", fmt.Errorf("decode yaml error: %s", err)
+		}
+		if v, err = stringKeys(v); err != nil {
+			return nil, "", fmt.Errorf("convert yaml error: %s", err)
+		}
+		b, err = json.Marshal(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("convert yaml error: %s", err)
+		}
+	}
+	return b, hex.EncodeToString(hash[:]), nil
+}
+
+// stringKeys turns the maps yaml decodes with non-string keys, such as
+// numbers, into maps with string keys that json can encode.
+func stringKeys(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = e
+		}
+		return v, nil
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			switch k.(type) {
+			case string, int, int64, uint64, float64, bool:
+			default:
+				return nil, fmt.Errorf("unsupported key %v of type %T", k, k)
+			}
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = e
+		}
+		return m, nil
+	case []any:
+		for i, e := range v {
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// GetNodeInfo returns nil if the node file is unchanged.
+func (c *FileClient) GetNodeInfo() (*NodeInfo, error) {
+	if !c.dirty(&c.nodeDirty) {
+		return nil, nil
+	}
+	b, hash, err := readFile(c.NodeFile)
+	if err != nil {
+		c.nodeDirty.Store(true)
+		return nil, fmt.Errorf("read node file error: %s", err)
+	}
+	c.hashLock.Lock()
+	defer c.hashLock.Unlock()
+	if hash == c.nodeHash {
+		return nil, nil
+	}
+	node, err := parseNodeInfo(b, c.NodeId, "file")
+	if err != nil {
+		c.nodeDirty.Store(true)
+		return nil, err
+	}
+	c.nodeHash = hash
+	return node, nil
+}
+
+// GetUserList returns nil if the user file is unchanged.
+func (c *FileClient) GetUserList() ([]UserInfo, error) {
+	if !c.dirty(&c.userDirty) {
+		return nil, nil
+	}
+	b, hash, err := readFile(c.UserFile)
+	if err != nil {
+		c.userDirty.Store(true)
+		return nil, fmt.Errorf("read user file error: %s", err)
+	}
+	c.hashLock.Lock()
+	defer c.hashLock.Unlock()
+	if hash == c.userHash {
+		return nil, nil
+	}
+	userlist := &UserListBody{}
+	if err := json.Unmarshal(b, userlist); err != nil {
+		c.userDirty.Store(true)
+		return nil, fmt.Errorf("decode user list error: %s", err)
+	}
+	c.userHash = hash
+	if userlist.Users == nil {
+		userlist.Users = []UserInfo{}
+	}
+	return userlist.Users, nil
+}
+
+// GetUserAlive returns no devices, there are no other nodes to share them with.
+func (c *FileClient) GetUserAlive() (map[int]int, error) {
+	return make(map[int]int), nil
+}
+
+type trafficRecord struct {
+	Time    int64           `json:"time"`
+	NodeId  int             `json:"node_id"`
+	Traffic map[int][]int64 `json:"traffic"`
+}
+
+// ReportUserTraffic appends the traffic as one json line in the same shape the panel receives.
+func (c *FileClient) ReportUserTraffic(userTraffic []UserTraffic) error {
+	data := make(map[int][]int64, len(userTraffic))
+	for i := range userTraffic {
+		data[userTraffic[i].UID] = []int64{userTraffic[i].Upload, userTraffic[i].Download}
+	}
+	b, err := json.Marshal(trafficRecord{
+		Time:    time.Now().Unix(),
+		NodeId:  c.NodeId,
+		Traffic: data,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(c.TrafficFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open traffic file error: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write traffic file error: %s", err)
+	}
+	return f.Sync()
+}
+
+// ReportNodeOnlineUsers does nothing, the file backend has no online reporting.
+func (c *FileClient) ReportNodeOnlineUsers(_ *map[int][]string) error {
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"encoding/json"
+
+	"github.com/wyx2685/v2node/conf"
 )
 
 // Security type
@@ -28,6 +30,7 @@ type NodeInfo struct {
 	PullInterval time.Duration
 	Tag          string
 	Common       *CommonNode
+	Policy       conf.PolicyConfig // from BaseConfig and the local node config
 }
 
 type CommonNode struct {
@@ -35,6 +38,7 @@ type CommonNode struct {
 	ListenIP   string      `json:"listen_ip"`
 	ServerPort int         `json:"server_port"`
 	Routes     []Route     `json:"routes"`
+	AuditRules []AuditRule `json:"audit_rules"`
 	BaseConfig *BaseConfig `json:"base_config"`
 	//vless vmess trojan
 	Tls                int         `json:"tls"`
@@ -74,6 +78,13 @@ type BaseConfig struct {
 	PullInterval           any `json:"pull_interval"`
 	DeviceOnlineMinTraffic int `json:"device_online_min_traffic"`
 	NodeReportMinTraffic   int `json:"node_report_min_traffic"`
+	NodeSpeedLimit         int `json:"node_speed_limit"` // Mbps per direction for the whole node
+	// core policy, unset fields use the local config
+	Handshake    *uint32 `json:"handshake"`
+	ConnIdle     *uint32 `json:"conn_idle"`
+	UplinkOnly   *uint32 `json:"uplink_only"`
+	DownlinkOnly *uint32 `json:"downlink_only"`
+	BufferSize   *int32  `json:"buffer_size"`
 }
 
 type TlsSettings struct {
@@ -111,6 +122,7 @@ type EncSettings struct {
 }
 
 func (c *Client) GetNodeInfo() (node *NodeInfo, err error) {
+	defer func(start time.Time) { c.observe("GetNodeInfo", start, err) }(time.Now())
 	const path = "/api/v2/server/config"
 	r, err := c.client.
 		R().
@@ -141,12 +153,17 @@ func (c *Client) GetNodeInfo() (node *NodeInfo, err error) {
 	} else {
 		return nil, fmt.Errorf("received nil response")
 	}
-	node = &NodeInfo{
-		Id: c.NodeId,
+	return parseNodeInfo(r.Body(), c.NodeId, c.APIHost)
+}
+
+// parseNodeInfo builds the NodeInfo from a CommonNode json body.
+func parseNodeInfo(body []byte, nodeId int, host string) (*NodeInfo, error) {
+	node := &NodeInfo{
+		Id: nodeId,
 	}
 	// parse protocol params
 	cm := &CommonNode{}
-	err = json.Unmarshal(r.Body(), cm)
+	err := json.Unmarshal(body, cm)
 	if err != nil {
 		return nil, fmt.Errorf("decode node params error: %s", err)
 	}
@@ -160,14 +177,14 @@ func (c *Client) GetNodeInfo() (node *NodeInfo, err error) {
 	default:
 		return nil, fmt.Errorf("unsupport protocol: %s", cm.Protocol)
 	}
-	node.Tag = fmt.Sprintf("[%s]-%s:%d", c.APIHost, node.Type, node.Id)
+	node.Tag = fmt.Sprintf("[%s]-%s:%d", host, node.Type, node.Id)
 	cf := cm.TlsSettings.CertFile
 	kf := cm.TlsSettings.KeyFile
 	if cf == "" {
-		cf = filepath.Join("/etc/v2node/", cm.Protocol+strconv.Itoa(c.NodeId)+".cer")
+		cf = filepath.Join("/etc/v2node/", cm.Protocol+strconv.Itoa(nodeId)+".cer")
 	}
 	if kf == "" {
-		kf = filepath.Join("/etc/v2node/", cm.Protocol+strconv.Itoa(c.NodeId)+".key")
+		kf = filepath.Join("/etc/v2node/", cm.Protocol+strconv.Itoa(nodeId)+".key")
 	}
 	cm.CertInfo = &CertInfo{
 		CertMode:         cm.TlsSettings.CertMode,
@@ -190,6 +207,9 @@ func (c *Client) GetNodeInfo() (node *NodeInfo, err error) {
 	}
 
 	// set interval
+	if cm.BaseConfig == nil {
+		cm.BaseConfig = &BaseConfig{PushInterval: 60, PullInterval: 60}
+	}
 	node.PushInterval = intervalToTime(cm.BaseConfig.PushInterval)
 	node.PullInterval = intervalToTime(cm.BaseConfig.PullInterval)
 
@@ -199,6 +219,9 @@ func (c *Client) GetNodeInfo() (node *NodeInfo, err error) {
 }
 
 func intervalToTime(i interface{}) time.Duration {
+	if i == nil {
+		return 60 * time.Second
+	}
 	switch reflect.TypeOf(i).Kind() {
 	case reflect.Int:
 		return time.Duration(i.(int)) * time.Second
@@ -2,17 +2,59 @@ package panel
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/wyx2685/v2node/common/metrics"
 	"github.com/wyx2685/v2node/conf"
 )
 
 // Panel is the interface for different panel's api.
+type Panel interface {
+	GetNodeInfo() (*NodeInfo, error)
+	GetUserList() ([]UserInfo, error)
+	GetUserAlive() (map[int]int, error)
+	ReportUserTraffic(userTraffic []UserTraffic) error
+	ReportNodeOnlineUsers(data *map[int][]string) error
+}
+
+// ETagPanel is implemented by panels whose responses carry ETags, so a
+// cached copy can be revalidated after a restart.
+type ETagPanel interface {
+	ETags() (node, user string)
+	SetETags(node, user string)
+}
+
+// WatchPanel is implemented by panels that learn of changes themselves, so
+// the node can pull at once instead of waiting for the next interval.
+type WatchPanel interface {
+	// Changed receives after a change, it is closed by Close.
+	Changed() <-chan struct{}
+	Close() error
+}
 
+// New returns the panel api selected by the ApiType of the node config.
+func New(c *conf.NodeConfig) (Panel, error) {
+	switch c.ApiType {
+	case "", "v2board":
+		return NewClient(c)
+	case "file":
+		return NewFileClient(c)
+	default:
+		return nil, fmt.Errorf("unsupported api type: %s", c.ApiType)
+	}
+}
+
+var (
+	_ Panel     = (*Client)(nil)
+	_ ETagPanel = (*Client)(nil)
+)
+
+// Client is the Panel for the v2board UniProxy api.
 type Client struct {
 	client           *resty.Client
 	APIHost          string
@@ -20,12 +62,13 @@ type Client struct {
 	NodeId           int
 	nodeEtag         string
 	userEtag         string
+	banEtag          string
 	responseBodyHash string
 	UserList         *UserListBody
 	AliveMap         *AliveMap
 }
 
-func New(c *conf.NodeConfig) (*Client, error) {
+func NewClient(c *conf.NodeConfig) (*Client, error) {
 	client := resty.New()
 	client.SetRetryCount(3)
 	if c.Timeout > 0 {
@@ -57,3 +100,20 @@ func New(c *conf.NodeConfig) (*Client, error) {
 		AliveMap: &AliveMap{},
 	}, nil
 }
+
+// observe records the latency and outcome of a panel API call.
+func (c *Client) observe(call string, start time.Time, err error) {
+	id := strconv.Itoa(c.NodeId)
+	metrics.PanelRequestDuration.Observe(time.Since(start).Seconds(), c.APIHost, id, call)
+	if err != nil {
+		metrics.PanelRequestErrors.Inc(c.APIHost, id, call)
+	}
+}
+
+func (c *Client) ETags() (node, user string) {
+	return c.nodeEtag, c.userEtag
+}
+
+func (c *Client) SetETags(node, user string) {
+	c.nodeEtag, c.userEtag = node, user
+}
@@ -3,6 +3,7 @@ package panel
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"encoding/json/jsontext"
 	"encoding/json/v2"
@@ -16,10 +17,14 @@ type OnlineUser struct {
 }
 
 type UserInfo struct {
-	Id          int    `json:"id" msgpack:"id"`
-	Uuid        string `json:"uuid" msgpack:"uuid"`
-	SpeedLimit  int    `json:"speed_limit" msgpack:"speed_limit"`
-	DeviceLimit int    `json:"device_limit" msgpack:"device_limit"`
+	Id             int    `json:"id" msgpack:"id"`
+	Uuid           string `json:"uuid" msgpack:"uuid"`
+	SpeedLimit     int    `json:"speed_limit" msgpack:"speed_limit"`
+	SpeedLimitUp   int    `json:"speed_limit_up" msgpack:"speed_limit_up"`
+	SpeedLimitDown int    `json:"speed_limit_down" msgpack:"speed_limit_down"`
+	DeviceLimit    int    `json:"device_limit" msgpack:"device_limit"`
+	ConnLimit      int    `json:"conn_limit" msgpack:"conn_limit"`
+	Remaining      *int64 `json:"remaining,omitempty" msgpack:"remaining,omitempty"` // bytes left, nil is unlimited
 }
 
 type UserListBody struct {
@@ -31,7 +36,8 @@ type AliveMap struct {
 }
 
 // GetUserList will pull user from v2board
-func (c *Client) GetUserList() ([]UserInfo, error) {
+func (c *Client) GetUserList() (users []UserInfo, err error) {
+	defer func(start time.Time) { c.observe("GetUserList", start, err) }(time.Now())
 	const path = "/api/v1/server/UniProxy/user"
 	r, err := c.client.R().
 		SetHeader("If-None-Match", c.userEtag).
@@ -86,6 +92,10 @@ func (c *Client) GetUserList() ([]UserInfo, error) {
 		}
 	}
 	c.userEtag = r.Header().Get("ETag")
+	if userlist.Users == nil {
+		// nil means not modified, the panel really has no users
+		userlist.Users = []UserInfo{}
+	}
 	return userlist.Users, nil
 }
 
@@ -93,10 +103,15 @@ func (c *Client) GetUserList() ([]UserInfo, error) {
 func (c *Client) GetUserAlive() (map[int]int, error) {
 	c.AliveMap = &AliveMap{}
 	const path = "/api/v1/server/UniProxy/alivelist"
+	start := time.Now()
 	r, err := c.client.R().
 		ForceContentType("application/json").
 		Get(path)
-	if err != nil || r.StatusCode() >= 399 {
+	if err == nil && r.StatusCode() >= 399 {
+		err = fmt.Errorf("status code %d", r.StatusCode())
+	}
+	c.observe("GetUserAlive", start, err)
+	if err != nil {
 		c.AliveMap.Alive = make(map[int]int)
 		return c.AliveMap.Alive, nil
 	}
@@ -121,32 +136,38 @@ type UserTraffic struct {
 }
 
 // ReportUserTraffic reports the user traffic
-func (c *Client) ReportUserTraffic(userTraffic []UserTraffic) error {
+func (c *Client) ReportUserTraffic(userTraffic []UserTraffic) (err error) {
+	defer func(start time.Time) { c.observe("ReportUserTraffic", start, err) }(time.Now())
 	data := make(map[int][]int64, len(userTraffic))
 	for i := range userTraffic {
 		data[userTraffic[i].UID] = []int64{userTraffic[i].Upload, userTraffic[i].Download}
 	}
 	const path = "/api/v1/server/UniProxy/push"
-	_, err := c.client.R().
+	r, err := c.client.R().
 		SetBody(data).
 		ForceContentType("application/json").
 		Post(path)
 	if err != nil {
 		return err
 	}
+	if r.StatusCode() >= 400 {
+		return fmt.Errorf("report user traffic error: status code %d", r.StatusCode())
+	}
 	return nil
 }
 
-func (c *Client) ReportNodeOnlineUsers(data *map[int][]string) error {
+func (c *Client) ReportNodeOnlineUsers(data *map[int][]string) (err error) {
+	defer func(start time.Time) { c.observe("ReportNodeOnlineUsers", start, err) }(time.Now())
 	const path = "/api/v1/server/UniProxy/alive"
-	_, err := c.client.R().
+	r, err := c.client.R().
 		SetBody(data).
 		ForceContentType("application/json").
 		Post(path)
-
 	if err != nil {
-		return nil
+		return err
+	}
+	if r.StatusCode() >= 400 {
+		return fmt.Errorf("report online users error: status code %d", r.StatusCode())
 	}
-
 	return nil
 }
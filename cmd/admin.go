@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/conf"
+	"github.com/wyx2685/v2node/core"
+	"github.com/wyx2685/v2node/core/app/dispatcher"
+	"github.com/wyx2685/v2node/limiter"
+	"github.com/wyx2685/v2node/node"
+)
+
+// adminServer is the local HTTP API for inspecting and controlling the
+// running nodes. The server loop swaps nodes and core on reload.
+type adminServer struct {
+	token    string
+	configCh chan struct{}
+	access   sync.RWMutex
+	nodes    *node.Node
+	core     *core.V2Core
+}
+
+type adminNode struct {
+	Tag            string          `json:"tag"`
+	APIHost        string          `json:"api_host"`
+	NodeID         int             `json:"node_id"`
+	Running        bool            `json:"running"`
+	Error          string          `json:"error,omitempty"`
+	PendingTraffic int64           `json:"pending_traffic"`
+	Info           *panel.NodeInfo `json:"info"`
+}
+
+func newAdminServer(c *conf.AdminConfig, configCh chan struct{}) (*adminServer, error) {
+	if c.Token == "" {
+		return nil, fmt.Errorf("admin token is required")
+	}
+	return &adminServer{
+		token:    c.Token,
+		configCh: configCh,
+	}, nil
+}
+
+// listen only accepts a unix socket or a loopback address.
+func (a *adminServer) listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		return listenUnix(path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin api must listen on loopback or unix socket, got %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (a *adminServer) Start(addr string) error {
+	l, err := a.listen(addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /nodes", a.handleNodes)
+	mux.HandleFunc("GET /online", a.handleOnline)
+	mux.HandleFunc("GET /traffic", a.handleTraffic)
+	mux.HandleFunc("GET /links", a.handleLinks)
+	mux.HandleFunc("GET /throttled", a.handleThrottled)
+	mux.HandleFunc("POST /kick", a.handleKick)
+	mux.HandleFunc("GET /bans", a.handleBans)
+	mux.HandleFunc("POST /ban", a.handleBan)
+	mux.HandleFunc("POST /unban", a.handleUnban)
+	mux.HandleFunc("POST /reload", a.handleReload)
+	mux.HandleFunc("POST /sync", a.handleSync)
+	go func() {
+		log.Infof("Starting admin api on %s", addr)
+		if err := http.Serve(l, a.auth(mux)); err != nil {
+			log.WithField("err", err).Error("admin api failed")
+		}
+	}()
+	return nil
+}
+
+func (a *adminServer) set(nodes *node.Node, v2core *core.V2Core) {
+	a.access.Lock()
+	a.nodes = nodes
+	a.core = v2core
+	a.access.Unlock()
+}
+
+func (a *adminServer) get() (*node.Node, *core.V2Core) {
+	a.access.RLock()
+	defer a.access.RUnlock()
+	return a.nodes, a.core
+}
+
+func (a *adminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// controllers returns the controllers matching the tag query, or all of them.
+func (a *adminServer) controllers(r *http.Request) []*node.Controller {
+	nodes, _ := a.get()
+	if nodes == nil {
+		return nil
+	}
+	all := nodes.Controllers()
+	if r.URL.Path != "/nodes" {
+		// only the node list shows nodes that are not running
+		running := all[:0]
+		for _, c := range all {
+			if c.Running() {
+				running = append(running, c)
+			}
+		}
+		all = running
+	}
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		return all
+	}
+	for _, c := range all {
+		if c.Tag() == tag {
+			return []*node.Controller{c}
+		}
+	}
+	return nil
+}
+
+func (a *adminServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	result := []adminNode{}
+	for _, c := range a.controllers(r) {
+		running, err := c.Status()
+		n := adminNode{
+			Tag:            c.Tag(),
+			APIHost:        c.Config().APIHost,
+			NodeID:         c.Config().NodeID,
+			Running:        running,
+			PendingTraffic: c.PendingTraffic(),
+			Info:           c.Info(),
+		}
+		if err != nil {
+			n.Error = err.Error()
+		}
+		result = append(result, n)
+	}
+	writeJSON(w, result)
+}
+
+func (a *adminServer) handleOnline(w http.ResponseWriter, r *http.Request) {
+	result := map[string][]panel.OnlineUser{}
+	for _, c := range a.controllers(r) {
+		result[c.Tag()] = c.OnlineUsers()
+	}
+	writeJSON(w, result)
+}
+
+func (a *adminServer) handleThrottled(w http.ResponseWriter, r *http.Request) {
+	result := map[string][]limiter.ThrottledUser{}
+	for _, c := range a.controllers(r) {
+		result[c.Tag()] = c.Throttled()
+	}
+	writeJSON(w, result)
+}
+
+func (a *adminServer) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	_, v2core := a.get()
+	result := map[string][]panel.UserTraffic{}
+	for _, c := range a.controllers(r) {
+		result[c.Tag()] = v2core.PeekUserTraffic(c.Tag())
+	}
+	writeJSON(w, result)
+}
+
+func (a *adminServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(r.URL.Query().Get("uid"))
+	if err != nil {
+		http.Error(w, "invalid uid", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	ip := query.Get("ip")
+	if ip != "" {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		ip = addr.Unmap().String()
+	}
+	var ban time.Duration
+	if v := query.Get("ban"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes < 0 || ip == "" {
+			http.Error(w, "ban needs an ip and minutes", http.StatusBadRequest)
+			return
+		}
+		ban = time.Duration(minutes) * time.Minute
+	}
+	nodes, _ := a.get()
+	if nodes == nil {
+		writeJSON(w, map[string]int{"closed": 0})
+		return
+	}
+	closed := nodes.Kick(query.Get("tag"), uid, ip, ban)
+	writeJSON(w, map[string]int{"closed": closed})
+}
+
+func (a *adminServer) handleBans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, limiter.Bans())
+}
+
+// handleBan bans an ip or cidr on the host, for ever unless minutes is set.
+func (a *adminServer) handleBan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var d time.Duration
+	if v := query.Get("minutes"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes < 0 {
+			http.Error(w, "invalid minutes", http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(minutes) * time.Minute
+	}
+	if err := limiter.BanIP(query.Get("ip"), d, query.Get("reason"), "admin"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func (a *adminServer) handleUnban(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]bool{"removed": limiter.UnbanIP(r.URL.Query().Get("ip"))})
+}
+
+func (a *adminServer) handleLinks(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(r.URL.Query().Get("uid"))
+	if err != nil {
+		http.Error(w, "invalid uid", http.StatusBadRequest)
+		return
+	}
+	_, v2core := a.get()
+	result := map[string][]dispatcher.LinkInfo{}
+	for _, c := range a.controllers(r) {
+		if links := v2core.UserLinks(c.Tag(), uid); len(links) > 0 {
+			result[c.Tag()] = links
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, _ *http.Request) {
+	select {
+	case a.configCh <- struct{}{}:
+	default: // a reload is already queued
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *adminServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	cs := a.controllers(r)
+	for _, c := range cs {
+		c.Sync()
+	}
+	writeJSON(w, map[string]int{"synced": len(cs)})
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix creates the socket at path readable by the owner only, the
+// umask is set around Listen so it is never open to others.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
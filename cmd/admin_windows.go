@@ -0,0 +1,7 @@
+package cmd
+
+import "net"
+
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
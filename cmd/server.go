@@ -1,22 +1,30 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/wyx2685/v2node/common/metrics"
 	"github.com/wyx2685/v2node/conf"
 	"github.com/wyx2685/v2node/core"
 	"github.com/wyx2685/v2node/limiter"
 	"github.com/wyx2685/v2node/node"
 )
 
+// errNoCore is returned by reload when neither the new nor the previous
+// config could be started.
+var errNoCore = errors.New("no core running")
+
 var (
 	config string
 	watch  bool
@@ -78,8 +86,27 @@ func serverHandle(_ *cobra.Command, _ []string) {
 			}
 		}()
 	}
+	// Enable prometheus metrics if configured
+	if c.MetricsListen != "" {
+		go func() {
+			log.Infof("Starting metrics server on %s", c.MetricsListen)
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			if err := http.ListenAndServe(c.MetricsListen, mux); err != nil {
+				log.WithField("err", err).Error("metrics server failed")
+			}
+		}()
+	}
 	//init limiter
 	limiter.Init()
+	if err := limiter.SetDeviceConfig(&c.DeviceConfig); err != nil {
+		log.WithField("err", err).Error("Load device config failed")
+		return
+	}
+	if err := limiter.LoadBans(c.BanConfig.File); err != nil {
+		log.WithField("err", err).Error("Load ban list failed")
+		return
+	}
 	//get node info
 	nodes, err := node.New(c.NodeConfigs)
 	if err != nil {
@@ -104,11 +131,25 @@ func serverHandle(_ *cobra.Command, _ []string) {
 		return
 	}
 	log.Info("Nodes started")
+	var configCh = make(chan struct{}, 1)
+	var admin *adminServer
+	if c.AdminConfig.Listen != "" {
+		admin, err = newAdminServer(&c.AdminConfig, configCh)
+		if err == nil {
+			// set before serving so no request sees a nil node
+			admin.set(nodes, v2core)
+			err = admin.Start(c.AdminConfig.Listen)
+		}
+		if err != nil {
+			log.WithField("err", err).Error("start admin api failed")
+			return
+		}
+	}
 	if watch {
 		// On file change, just signal reload; do not run reload concurrently here
 		err = c.Watch(config, func() {
 			select {
-			case reloadCh <- struct{}{}:
+			case configCh <- struct{}{}:
 			default: // drop if a reload is already queued
 			}
 		})
@@ -127,38 +168,164 @@ func serverHandle(_ *cobra.Command, _ []string) {
 		select {
 		case <-osSignals:
 			log.Info("收到退出信号，正在关闭程序...")
+			go func() {
+				// a second signal skips the drain
+				<-osSignals
+				log.Warn("收到第二次退出信号，强制退出")
+				os.Exit(1)
+			}()
+			nodes.Shutdown(v2core, time.Duration(v2core.Config.DrainTimeout)*time.Second)
+			if err := v2core.Close(); err != nil {
+				log.WithField("err", err).Error("Close core failed")
+			}
+			limiter.SaveBans()
 			os.Exit(0)
+		case <-configCh:
+			log.Info("配置文件已修改，正在重新加载节点...")
+			done, err := reloadNodes(config, nodes, v2core)
+			if err != nil {
+				log.WithField("err", err).Error("重新加载节点失败，继续使用当前配置")
+				continue
+			}
+			if done {
+				log.Info("重新加载节点成功")
+				continue
+			}
+			log.Info("配置变更需要重启内核")
+			restart(config, &nodes, &v2core, admin)
 		case <-reloadCh:
 			log.Info("收到重启信号，正在重新加载配置...")
-			if err := reload(config, &nodes, &v2core); err != nil {
-				log.WithField("err", err).Panic("重启失败")
-			}
-			log.Info("重启成功")
+			restart(config, &nodes, &v2core, admin)
 		}
 	}
 }
 
+// restart runs a full reload and logs the outcome, a failed reload leaves the
+// previous core running when it could be kept or restored.
+func restart(config string, nodes **node.Node, v2core **core.V2Core, admin *adminServer) {
+	err := reload(config, nodes, v2core)
+	if errors.Is(err, errNoCore) {
+		limiter.SaveBans()
+		log.WithField("err", err).Fatal("重启失败，没有可用的内核")
+	}
+	if admin != nil {
+		admin.set(*nodes, *v2core)
+	}
+	if err != nil {
+		log.WithField("err", err).Error("重启失败")
+		return
+	}
+	log.Info("重启成功")
+}
+
+// reloadNodes applies a changed config file by adding and removing nodes on the
+// running core. It reports false when anything else changed, in which case the
+// caller falls back to a full reload.
+func reloadNodes(config string, nodes *node.Node, v2core *core.V2Core) (bool, error) {
+	newConf := conf.New()
+	if err := newConf.LoadFromPath(config); err != nil {
+		return false, err
+	}
+	oldGlobal, newGlobal := *v2core.Config, *newConf
+	oldGlobal.NodeConfigs, newGlobal.NodeConfigs = nil, nil
+	if !reflect.DeepEqual(oldGlobal, newGlobal) {
+		return false, nil
+	}
+	done, err := nodes.Reload(newConf.NodeConfigs, v2core)
+	if done {
+		v2core.Config = newConf
+	}
+	return done, err
+}
+
+// reload restarts the core with the config file. The new config is loaded
+// and its nodes prepared before anything is closed, so a bad config keeps
+// the running core. If the new core fails to start the previous config is
+// started again, when that fails too errNoCore is returned and no core is
+// running.
 func reload(config string, nodes **node.Node, v2core **core.V2Core) error {
-	// Preserve old reload channel so new core continues to receive signals
-	var oldReloadCh chan struct{}
-	if *v2core != nil {
-		oldReloadCh = (*v2core).ReloadCh
+	newConf := conf.New()
+	if err := newConf.LoadFromPath(config); err != nil {
+		return fmt.Errorf("load config error: %s", err)
+	}
+	newNodes, err := node.New(newConf.NodeConfigs)
+	if err != nil {
+		return fmt.Errorf("prepare nodes error: %s", err)
+	}
+	if err := applyGlobal(newConf); err != nil {
+		newNodes.Close()
+		// the old settings may be half replaced
+		if rerr := applyGlobal((*v2core).Config); rerr != nil {
+			log.WithField("err", rerr).Error("Restore global settings failed")
+		}
+		return err
 	}
 
+	// Preserve old reload channel so new core continues to receive signals
+	oldConf := (*v2core).Config
+	reloadCh := (*v2core).ReloadCh
 	if err := (*nodes).Close(); err != nil {
+		// every node is closed anyway, go on with the new core
+		log.WithField("err", err).Error("Close nodes failed")
+	}
+	if err := (*v2core).Close(); err != nil {
+		// the core is unusable after Close either way
+		log.WithField("err", err).Error("Close core failed")
+	}
+
+	if err = start(newConf, newNodes, reloadCh, nodes, v2core); err != nil {
+		log.WithField("err", err).Error("Start new core failed, restoring previous config")
+		if rerr := applyGlobal(oldConf); rerr != nil {
+			log.WithField("err", rerr).Error("Restore global settings failed")
+		}
+		oldNodes, rerr := node.New(oldConf.NodeConfigs)
+		if rerr == nil {
+			rerr = start(oldConf, oldNodes, reloadCh, nodes, v2core)
+		}
+		if rerr != nil {
+			return fmt.Errorf("%w: %s, restore previous config error: %s", errNoCore, err, rerr)
+		}
 		return err
 	}
+	runtime.GC()
+	return nil
+}
 
-	if err := (*v2core).Close(); err != nil {
+// applyGlobal applies the device, ban and log settings of c.
+func applyGlobal(c *conf.Conf) error {
+	if err := limiter.SetDeviceConfig(&c.DeviceConfig); err != nil {
 		return err
 	}
+	if err := limiter.LoadBans(c.BanConfig.File); err != nil {
+		return err
+	}
+	setLog(c)
+	return nil
+}
 
-	newConf := conf.New()
-	if err := newConf.LoadFromPath(config); err != nil {
+// start starts a core for c with the prepared nodes, storing both on
+// success. The nodes are closed if it fails.
+func start(c *conf.Conf, newNodes *node.Node, reloadCh chan struct{}, nodes **node.Node, v2core **core.V2Core) error {
+	newCore := core.New(c)
+	// Reattach reload channel
+	newCore.ReloadCh = reloadCh
+	if err := newCore.Start(newNodes.NodeInfos); err != nil {
+		newNodes.Close()
 		return err
 	}
+	if err := newNodes.Start(c.NodeConfigs, newCore); err != nil {
+		newNodes.Close()
+		newCore.Close()
+		return err
+	}
+	*nodes = newNodes
+	*v2core = newCore
+	return nil
+}
 
-	switch newConf.LogConfig.Level {
+// setLog applies the log level and output of c.
+func setLog(c *conf.Conf) {
+	switch c.LogConfig.Level {
 	case "debug":
 		log.SetLevel(log.DebugLevel)
 	case "info":
@@ -168,8 +335,8 @@ func reload(config string, nodes **node.Node, v2core **core.V2Core) error {
 	case "error":
 		log.SetLevel(log.ErrorLevel)
 	}
-	if newConf.LogConfig.Output != "" {
-		f, err := os.OpenFile(newConf.LogConfig.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if c.LogConfig.Output != "" {
+		f, err := os.OpenFile(c.LogConfig.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			log.WithField("err", err).Error("Open log file failed, using stdout instead")
 		} else {
@@ -180,26 +347,4 @@ func reload(config string, nodes **node.Node, v2core **core.V2Core) error {
 			log.SetOutput(f)
 		}
 	}
-
-	newNodes, err := node.New(newConf.NodeConfigs)
-	if err != nil {
-		return err
-	}
-
-	newCore := core.New(newConf)
-	// Reattach reload channel
-	newCore.ReloadCh = oldReloadCh
-	if err := newCore.Start(newNodes.NodeInfos); err != nil {
-		return err
-	}
-
-	if err := newNodes.Start(newConf.NodeConfigs, newCore); err != nil {
-		return err
-	}
-
-	*nodes = newNodes
-	*v2core = newCore
-
-	runtime.GC()
-	return nil
 }
@@ -0,0 +1,171 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wyx2685/v2node/conf"
+)
+
+const (
+	backupTimeFormat = "20060102-150405.000"
+	// rotateRetry is how long the log waits to rotate again after a failure
+	rotateRetry = time.Minute
+)
+
+// Entry is one closed user link.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	UID         int       `json:"uid"`
+	Tag         string    `json:"tag"`
+	Source      string    `json:"src"`
+	Destination string    `json:"dest"`
+	Domain      string    `json:"domain,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Outbound    string    `json:"outbound,omitempty"`
+	Up          int64     `json:"up"`
+	Down        int64     `json:"down"`
+	Duration    int64     `json:"duration_ms"`
+}
+
+// Logger writes entries as json lines, rotating the file by size and age.
+type Logger struct {
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	sample      float64
+	mu          sync.Mutex
+	file        *os.File
+	size        int64
+	opened      time.Time
+	retry       time.Time // no rotation before, after one failed
+}
+
+// New opens the access log of c, it returns nil if the log is disabled.
+func New(c *conf.AccessJSONConfig) (*Logger, error) {
+	if c.Path == "" {
+		return nil, nil
+	}
+	l := &Logger{
+		path:        c.Path,
+		maxSize:     int64(c.MaxSize) * 1024 * 1024,
+		rotateEvery: time.Duration(c.RotateHours) * time.Hour,
+		maxBackups:  c.MaxBackups,
+		sample:      c.Sample,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sampled reports whether a new link should be logged.
+func (l *Logger) Sampled() bool {
+	return l.sample <= 0 || l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// Write appends e to the log, rotating the file first if it is due.
+func (l *Logger) Write(e *Entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if (l.maxSize > 0 && l.size+int64(len(b)) > l.maxSize ||
+		l.rotateEvery > 0 && time.Since(l.opened) >= l.rotateEvery) && time.Now().After(l.retry) {
+		if err := l.rotate(); err != nil {
+			l.retry = time.Now().Add(rotateRetry)
+			log.WithFields(log.Fields{
+				"path": l.path,
+				"err":  err,
+			}).Errorf("Rotate access log failed, writing to the current file and retrying in %s", rotateRetry)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": l.path,
+			"err":  err,
+		}).Error("Write access log failed")
+	}
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the log file for appending, the caller holds l.mu.
+func (l *Logger) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("create access log dir error: %s", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("open access log error: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open access log error: %s", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// rotate moves the current file aside and opens a new one, the caller holds
+// l.mu. The current handle is only closed once the new file is open, so a
+// failure leaves the log writing where it was.
+func (l *Logger) rotate() error {
+	err := os.Rename(l.path, l.path+"."+time.Now().Format(backupTimeFormat))
+	// not there if an earlier rotation moved it and then failed to open
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	old.Close()
+	l.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (l *Logger) prune() {
+	if l.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(l.path + ".*")
+	if err != nil || len(backups) <= l.maxBackups {
+		return
+	}
+	// the time suffix sorts in age order
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-l.maxBackups] {
+		os.Remove(b)
+	}
+}
@@ -0,0 +1,128 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, path string) *Logger {
+	t.Helper()
+	l := &Logger{path: path}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := newTestLogger(t, path)
+	l.Write(&Entry{UID: 1})
+	l.maxSize = l.size + 1
+	l.Write(&Entry{UID: 2})
+	if n := len(backups(t, path)); n != 1 {
+		t.Fatalf("%d backups after the file grew past its size, want 1", n)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != l.size || l.size >= l.maxSize {
+		t.Fatalf("new file is %d bytes, logger counts %d", info.Size(), l.size)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := newTestLogger(t, path)
+	l.rotateEvery = time.Hour
+	l.Write(&Entry{UID: 1})
+	if n := len(backups(t, path)); n != 0 {
+		t.Fatalf("%d backups of a new file, want 0", n)
+	}
+	l.opened = time.Now().Add(-time.Hour)
+	l.Write(&Entry{UID: 2})
+	if n := len(backups(t, path)); n != 1 {
+		t.Fatalf("%d backups after the file got old, want 1", n)
+	}
+	if time.Since(l.opened) > time.Minute {
+		t.Fatal("rotated file keeps the old open time")
+	}
+}
+
+// Rotation keeps the newest maxBackups files.
+func TestRotatePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := newTestLogger(t, path)
+	l.maxBackups = 2
+	old := time.Now().Add(-time.Hour)
+	for i := range 3 {
+		name := path + "." + old.Add(time.Duration(i)*time.Minute).Format(backupTimeFormat)
+		if err := os.WriteFile(name, nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	got := backups(t, path)
+	if len(got) != 2 {
+		t.Fatalf("backups = %v, want 2", got)
+	}
+	newest := path + "." + old.Add(2*time.Minute).Format(backupTimeFormat)
+	if got[0] != newest {
+		t.Fatalf("kept %v, want %s and the new one", got, newest)
+	}
+}
+
+// A failed rotation keeps writing to the current file and is only tried
+// again after rotateRetry.
+func TestRotateRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	path := filepath.Join(dir, "access.log")
+	l := newTestLogger(t, path)
+	l.maxSize = 1
+	// a file in place of the dir makes the rename fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	l.Write(&Entry{UID: 1})
+	if !l.retry.After(time.Now()) {
+		t.Fatal("failed rotation is not delayed")
+	}
+	if l.size == 0 {
+		t.Fatal("entry not written to the current file")
+	}
+	retry := l.retry
+	l.Write(&Entry{UID: 2})
+	if l.retry != retry {
+		t.Fatal("rotation tried again before rotateRetry")
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	l.retry = time.Now().Add(-time.Second)
+	l.Write(&Entry{UID: 3})
+	if l.retry.After(time.Now()) {
+		t.Fatal("rotation failed after the cause was gone")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no new file after the retry: %s", err)
+	}
+}
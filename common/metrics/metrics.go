@@ -0,0 +1,321 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric families exported in the Prometheus text format.
+var (
+	TrafficBytes = NewCounter("v2node_traffic_bytes_total",
+		"User traffic taken from the core counters.", "tag", "direction")
+	PendingTrafficBytes = NewGauge("v2node_traffic_pending_bytes",
+		"Traffic waiting to be accepted by the panel.", "tag")
+	OnlineUsers = NewGauge("v2node_online_users",
+		"Users seen online since the last report.", "tag")
+	OnlineIPs = NewGauge("v2node_online_ips",
+		"Source IPs seen online since the last report.", "tag")
+	ThrottledUsers = NewGauge("v2node_throttled_users",
+		"Users held by a dynamic speed limit.", "tag")
+	DeviceLimitRejects = NewCounter("v2node_device_limit_rejects_total",
+		"Connections rejected by the device limit.", "tag")
+	ConnLimitRejects = NewCounter("v2node_conn_limit_rejects_total",
+		"Connections rejected by the concurrent connection limit.", "tag")
+	BanRejects = NewCounter("v2node_ban_rejects_total",
+		"Connections rejected because the source ip is banned.", "tag")
+	AuthFailures = NewCounter("v2node_auth_failures_total",
+		"Handshakes rejected by an inbound, e.g. for an unknown user.")
+	AuthBans = NewCounter("v2node_auth_bans_total",
+		"Source ips banned for repeated handshake failures.")
+	AuditHits = NewCounter("v2node_audit_hits_total",
+		"Links rejected by an audit rule.", "tag")
+	QuotaCutoffs = NewCounter("v2node_quota_cutoffs_total",
+		"Links cut off because the user quota ran out.", "tag")
+	PanelRequestDuration = NewHistogram("v2node_panel_request_duration_seconds",
+		"Latency of panel API calls.", DefaultBuckets, "api_host", "node_id", "call")
+	PanelRequestErrors = NewCounter("v2node_panel_request_errors_total",
+		"Failed panel API calls.", "api_host", "node_id", "call")
+	TaskDuration = NewHistogram("v2node_task_duration_seconds",
+		"Execution time of periodic tasks.", DefaultBuckets, "api_host", "node_id", "task")
+	CertExpiryDays = NewGauge("v2node_cert_expiry_days",
+		"Days until the node certificate expires.", "tag")
+	NodeUp = NewGauge("v2node_node_up",
+		"Whether the node is running, 0 while its start is being retried.", "api_host", "node_id")
+)
+
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type family interface {
+	write(w *bufio.Writer)
+	name() string
+}
+
+var (
+	registryLock sync.RWMutex
+	families     []family
+	collectors   = map[string]func(){}
+	// scrapeLock makes a whole scrape one step, so a collector resetting
+	// and refilling a family never runs next to another scrape writing it.
+	scrapeLock sync.Mutex
+)
+
+func register(f family) {
+	registryLock.Lock()
+	families = append(families, f)
+	registryLock.Unlock()
+}
+
+// RegisterCollector adds fn to be run before every scrape, to refresh
+// values that are cheaper to read on demand than to track.
+func RegisterCollector(key string, fn func()) {
+	registryLock.Lock()
+	collectors[key] = fn
+	registryLock.Unlock()
+}
+
+func UnregisterCollector(key string) {
+	registryLock.Lock()
+	delete(collectors, key)
+	registryLock.Unlock()
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		scrapeLock.Lock()
+		defer scrapeLock.Unlock()
+		registryLock.RLock()
+		fns := make([]func(), 0, len(collectors))
+		for _, fn := range collectors {
+			fns = append(fns, fn)
+		}
+		fs := append([]family(nil), families...)
+		registryLock.RUnlock()
+		for _, fn := range fns {
+			fn()
+		}
+		sort.Slice(fs, func(i, j int) bool { return fs[i].name() < fs[j].name() })
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, f := range fs {
+			f.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type vec struct {
+	mu         sync.Mutex
+	metricName string
+	help       string
+	kind       string
+	labelNames []string
+	series     map[string]*series
+}
+
+func newVec(name, help, kind string, labelNames []string) vec {
+	return vec{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// get returns the series for labelValues, the caller holds v.mu.
+func (v *vec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Delete removes the series for labelValues.
+func (v *vec) Delete(labelValues ...string) {
+	v.mu.Lock()
+	delete(v.series, strings.Join(labelValues, "\xff"))
+	v.mu.Unlock()
+}
+
+// Reset removes all series.
+func (v *vec) Reset() {
+	v.mu.Lock()
+	v.series = make(map[string]*series)
+	v.mu.Unlock()
+}
+
+func (v *vec) sorted() []*series {
+	list := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].labels, "\xff") < strings.Join(list[j].labels, "\xff")
+	})
+	return list
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, v.kind)
+}
+
+// labelEscaper escapes a label value as the text format wants it. Only
+// backslash, double quote and newline are escaped, anything else is written
+// as is, so a value is valid utf-8 in and out.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(s, "\uFFFD")) + `"`
+}
+
+func (v *vec) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range v.labelNames {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(n)
+		sb.WriteString("=")
+		sb.WriteString(quoteLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra[i])
+		sb.WriteString("=")
+		sb.WriteString(quoteLabel(extra[i+1]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounter(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labelNames)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	c.get(labelValues).value += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(s.labels), formatValue(s.value))
+	}
+}
+
+type GaugeVec struct {
+	vec
+}
+
+func NewGauge(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labelNames)}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).value = value
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w)
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(s.labels), formatValue(s.value))
+	}
+}
+
+type HistogramVec struct {
+	vec
+	bounds []float64
+}
+
+func NewHistogram(name, help string, bounds []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec:    newVec(name, help, "histogram", labelNames),
+		bounds: bounds,
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, b := range h.bounds {
+		if value <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, s := range h.sorted() {
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(s.labels, "le", formatValue(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(s.labels), s.count)
+	}
+}
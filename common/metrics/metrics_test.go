@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Label values are written with only \\, \" and \n escaped, other characters as they are.
+func TestLabelValueEscaping(t *testing.T) {
+	g := NewGauge("v2node_test_label_escaping", "Label escaping test.", "tag", "reason")
+	g.Set(1, "节点-1", "bad \"auth\"\\\ttab\nline")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `v2node_test_label_escaping{tag="节点-1",reason="bad \"auth\"\\` + "\t" + `tab\nline"} 1` + "\n"
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, rec.Body.String())
+	}
+}
+
+func scrape() string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+// A counter is written with its header and one sorted line per series.
+func TestCounterExposition(t *testing.T) {
+	c := NewCounter("v2node_test_counter_total", "Counter test.", "tag")
+	c.Add(2.5, "b")
+	c.Inc("a")
+	c.Inc("a")
+	want := "# HELP v2node_test_counter_total Counter test.\n" +
+		"# TYPE v2node_test_counter_total counter\n" +
+		"v2node_test_counter_total{tag=\"a\"} 2\n" +
+		"v2node_test_counter_total{tag=\"b\"} 2.5\n"
+	if body := scrape(); !strings.Contains(body, want) {
+		t.Fatalf("missing %q in:\n%s", want, body)
+	}
+}
+
+// A histogram has cumulative buckets ending in +Inf, then its sum and count.
+func TestHistogramExposition(t *testing.T) {
+	h := NewHistogram("v2node_test_histogram_seconds", "Histogram test.", []float64{0.1, 1}, "task")
+	h.Observe(0.05, "pull")
+	h.Observe(0.5, "pull")
+	h.Observe(3, "pull")
+	want := "# HELP v2node_test_histogram_seconds Histogram test.\n" +
+		"# TYPE v2node_test_histogram_seconds histogram\n" +
+		"v2node_test_histogram_seconds_bucket{task=\"pull\",le=\"0.1\"} 1\n" +
+		"v2node_test_histogram_seconds_bucket{task=\"pull\",le=\"1\"} 2\n" +
+		"v2node_test_histogram_seconds_bucket{task=\"pull\",le=\"+Inf\"} 3\n" +
+		"v2node_test_histogram_seconds_sum{task=\"pull\"} 3.55\n" +
+		"v2node_test_histogram_seconds_count{task=\"pull\"} 3\n"
+	if body := scrape(); !strings.Contains(body, want) {
+		t.Fatalf("missing %q in:\n%s", want, body)
+	}
+}
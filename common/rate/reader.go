@@ -0,0 +1,36 @@
+package rate
+
+import (
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+)
+
+// Reader limits what is read from a link, for the paths where the client
+// side is a reader, such as UDP relays and QUIC based inbounds.
+type Reader struct {
+	reader  buf.Reader
+	limiter Waiter
+}
+
+func NewRateLimitReader(reader buf.Reader, limiter Waiter) buf.Reader {
+	return &Reader{
+		reader:  reader,
+		limiter: limiter,
+	}
+}
+
+func (r *Reader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.reader.ReadMultiBuffer()
+	if n := mb.Len(); n > 0 {
+		r.limiter.Wait(int64(n))
+	}
+	return mb, err
+}
+
+func (r *Reader) Interrupt() {
+	common.Interrupt(r.reader)
+}
+
+func (r *Reader) Close() error {
+	return common.Close(r.reader)
+}
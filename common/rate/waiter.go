@@ -0,0 +1,15 @@
+package rate
+
+// Waiter blocks until n more bytes may pass. *ratelimit.Bucket is a Waiter.
+type Waiter interface {
+	Wait(n int64)
+}
+
+// Chain waits on every Waiter in turn.
+type Chain []Waiter
+
+func (c Chain) Wait(n int64) {
+	for _, w := range c {
+		w.Wait(n)
+	}
+}
@@ -1,17 +1,16 @@
 package rate
 
 import (
-	"github.com/juju/ratelimit"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 )
 
 type Writer struct {
 	writer  buf.Writer
-	limiter *ratelimit.Bucket
+	limiter Waiter
 }
 
-func NewRateLimitWriter(writer buf.Writer, limiter *ratelimit.Bucket) buf.Writer {
+func NewRateLimitWriter(writer buf.Writer, limiter Waiter) buf.Writer {
 	return &Writer{
 		writer:  writer,
 		limiter: limiter,
@@ -2,14 +2,18 @@ package task
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/wyx2685/v2node/common/metrics"
 )
 
 type Task struct {
 	Name     string
+	APIHost  string // with NodeID, the node the task runs for in its metrics
+	NodeID   int
 	Interval time.Duration
 	Execute  func() error
 	Reload   func()
@@ -63,7 +67,9 @@ func (t *Task) ExecuteWithTimeout() error {
 	done := make(chan error, 1)
 
 	go func() {
+		start := time.Now()
 		done <- t.Execute()
+		metrics.TaskDuration.Observe(time.Since(start).Seconds(), t.APIHost, strconv.Itoa(t.NodeID), t.Name)
 	}()
 
 	select {
@@ -87,5 +93,6 @@ func (t *Task) safeStop() {
 
 func (t *Task) Close() {
 	t.safeStop()
+	metrics.TaskDuration.Delete(t.APIHost, strconv.Itoa(t.NodeID), t.Name)
 	log.Warningf("Task %s stopped", t.Name)
 }
@@ -8,22 +8,116 @@ import (
 )
 
 type Conf struct {
-	LogConfig   LogConfig    `mapstructure:"Log"`
-	NodeConfigs []NodeConfig `mapstructure:"Nodes"`
-	PprofPort   int          `mapstructure:"PprofPort"`
+	LogConfig     LogConfig    `mapstructure:"Log"`
+	NodeConfigs   []NodeConfig `mapstructure:"Nodes"`
+	PprofPort     int          `mapstructure:"PprofPort"`
+	MetricsListen string       `mapstructure:"MetricsListen"`
+	DrainTimeout  int          `mapstructure:"DrainTimeout"` // seconds to wait for active links on shutdown
+	AdminConfig   AdminConfig  `mapstructure:"Admin"`
+	PolicyConfig  PolicyConfig `mapstructure:"Policy"`
+	DeviceConfig  DeviceConfig `mapstructure:"Device"`
+	BanConfig     BanConfig    `mapstructure:"Ban"`
+}
+
+// BanConfig sets where the ip ban list of the host is kept, and when an ip
+// failing to authenticate is banned automatically.
+type BanConfig struct {
+	File         string `mapstructure:"File"`         // default /etc/v2node/bans.json
+	AuthFailures int    `mapstructure:"AuthFailures"` // failed handshakes within AuthWindow that ban an ip, 0 disables
+	AuthWindow   int    `mapstructure:"AuthWindow"`   // seconds, default 60
+	AuthBanTime  int    `mapstructure:"AuthBanTime"`  // minutes, default 60
+}
+
+// DeviceConfig sets how source ips are counted as devices for the device limit.
+type DeviceConfig struct {
+	IPv4Prefix int      `mapstructure:"IPv4Prefix"` // 32 (default) or shorter, e.g. 24
+	IPv6Prefix int      `mapstructure:"IPv6Prefix"` // 128 (default) or shorter, e.g. 64 or 56
+	Allowlist  []string `mapstructure:"Allowlist"`  // cidrs that never count as a device
+}
+
+// DynamicSpeedLimitRule throttles a user to Limit Mbps for Duration minutes
+// once they transferred Traffic MB within Period minutes on the node.
+type DynamicSpeedLimitRule struct {
+	Traffic  int64 `mapstructure:"Traffic"`
+	Period   int   `mapstructure:"Period"`
+	Limit    int   `mapstructure:"Limit"`
+	Duration int   `mapstructure:"Duration"`
+}
+
+// PolicyConfig holds the core connection policy, unset fields are inherited.
+// Timeouts are in seconds and BufferSize in KB.
+type PolicyConfig struct {
+	// Handshake only works in the global policy. The core times the handshake
+	// before it knows the user and so the level of a node, a node policy or
+	// panel base config setting it is ignored with a warning.
+	Handshake    *uint32 `mapstructure:"Handshake" json:"handshake,omitempty"`
+	ConnIdle     *uint32 `mapstructure:"ConnIdle" json:"conn_idle,omitempty"`
+	UplinkOnly   *uint32 `mapstructure:"UplinkOnly" json:"uplink_only,omitempty"`
+	DownlinkOnly *uint32 `mapstructure:"DownlinkOnly" json:"downlink_only,omitempty"`
+	BufferSize   *int32  `mapstructure:"BufferSize" json:"buffer_size,omitempty"`
+}
+
+// Merge returns p with the fields set in o overridden.
+func (p PolicyConfig) Merge(o PolicyConfig) PolicyConfig {
+	if o.Handshake != nil {
+		p.Handshake = o.Handshake
+	}
+	if o.ConnIdle != nil {
+		p.ConnIdle = o.ConnIdle
+	}
+	if o.UplinkOnly != nil {
+		p.UplinkOnly = o.UplinkOnly
+	}
+	if o.DownlinkOnly != nil {
+		p.DownlinkOnly = o.DownlinkOnly
+	}
+	if o.BufferSize != nil {
+		p.BufferSize = o.BufferSize
+	}
+	return p
+}
+
+type AdminConfig struct {
+	Listen string `mapstructure:"Listen"` // loopback host:port or unix:/path/to.sock
+	Token  string `mapstructure:"Token"`
 }
 
 type LogConfig struct {
-	Level  string `mapstructure:"Level"`
-	Output string `mapstructure:"Output"`
-	Access string `mapstructure:"Access"`
+	Level      string           `mapstructure:"Level"`
+	Output     string           `mapstructure:"Output"`
+	Access     string           `mapstructure:"Access"`
+	AccessJSON AccessJSONConfig `mapstructure:"AccessJSON"`
+}
+
+// AccessJSONConfig sets the json access log, one line per closed user link.
+type AccessJSONConfig struct {
+	Path        string  `mapstructure:"Path"`        // empty disables it
+	MaxSize     int     `mapstructure:"MaxSize"`     // MB before the file is rotated, 0 never
+	RotateHours int     `mapstructure:"RotateHours"` // hours before the file is rotated, 0 never
+	MaxBackups  int     `mapstructure:"MaxBackups"`  // rotated files kept, 0 keeps all
+	Sample      float64 `mapstructure:"Sample"`      // fraction of links logged, 0 or 1 and above log all
 }
 
 type NodeConfig struct {
+	ApiType string `mapstructure:"ApiType"` // panel backend, v2board (default) or file
 	APIHost string `mapstructure:"ApiHost"`
 	NodeID  int    `mapstructure:"NodeID"`
 	Key     string `mapstructure:"ApiKey"`
 	Timeout int    `mapstructure:"Timeout"`
+	// keep the ban list in step with the panel
+	PullBanList bool `mapstructure:"PullBanList"`
+	// file backend
+	NodeFile    string `mapstructure:"NodeFile"`    // json or yaml node definition
+	UserFile    string `mapstructure:"UserFile"`    // json or yaml user list
+	TrafficFile string `mapstructure:"TrafficFile"` // reported traffic is appended here
+	// limits
+	SpeedLimitUp      int                     `mapstructure:"SpeedLimitUp"`   // node cap per user in Mbps
+	SpeedLimitDown    int                     `mapstructure:"SpeedLimitDown"` // node cap per user in Mbps
+	NodeSpeedLimit    int                     `mapstructure:"NodeSpeedLimit"` // total Mbps per direction, shared by all users
+	ConnLimit         int                     `mapstructure:"ConnLimit"`      // concurrent tcp and udp links per user, unless the panel sets one
+	DynamicSpeedLimit []DynamicSpeedLimitRule `mapstructure:"DynamicSpeedLimit"`
+	// overrides the global and panel policy for this node
+	PolicyConfig PolicyConfig `mapstructure:"Policy"`
 }
 
 func New() *Conf {
@@ -33,6 +127,7 @@ func New() *Conf {
 			Output: "",
 			Access: "none",
 		},
+		DrainTimeout: 30,
 	}
 }
 
@@ -29,13 +29,9 @@ func (p *Conf) Watch(filePath string, reload func()) error {
 				go func() {
 					time.Sleep(5 * time.Second)
 					log.Println("config file changed, reloading...")
-					*p = *New()
-					err := p.LoadFromPath(filePath)
-					if err != nil {
-						log.Printf("reload config error: %s", err)
-					}
+					// the reload callback loads the file itself and diffs it
+					// against the running config
 					reload()
-					log.Println("reload config success")
 				}()
 			case err := <-watcher.Errors:
 				if err != nil {
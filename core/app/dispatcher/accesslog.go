@@ -0,0 +1,106 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wyx2685/v2node/common/accesslog"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// SetAccessLog sets the json access log of the user links, nil turns it off.
+func (d *DefaultDispatcher) SetAccessLog(l *accesslog.Logger) {
+	d.accessLog.Store(l)
+}
+
+// linkLog collects the access log entry of one link. It is written once
+// the downlink is closed, when the routing of the link is known.
+type linkLog struct {
+	ctx    context.Context
+	logger *accesslog.Logger
+	uid    int
+	tag    string
+	src    string
+	start  time.Time
+	up     atomic.Int64
+	down   atomic.Int64
+	once   sync.Once
+}
+
+// newLinkLog returns the log of a new link, or nil if it is not logged.
+func (d *DefaultDispatcher) newLinkLog(ctx context.Context, uid int, tag, src string) *linkLog {
+	l := d.accessLog.Load()
+	if l == nil || !l.Sampled() {
+		return nil
+	}
+	return &linkLog{
+		ctx:    ctx,
+		logger: l,
+		uid:    uid,
+		tag:    tag,
+		src:    src,
+		start:  time.Now(),
+	}
+}
+
+func (l *linkLog) finish() {
+	l.once.Do(func() {
+		e := &accesslog.Entry{
+			Time:     l.start,
+			UID:      l.uid,
+			Tag:      l.tag,
+			Source:   l.src,
+			Up:       l.up.Load(),
+			Down:     l.down.Load(),
+			Duration: time.Since(l.start).Milliseconds(),
+		}
+		if outbounds := session.OutboundsFromContext(l.ctx); len(outbounds) > 0 {
+			ob := outbounds[len(outbounds)-1]
+			e.Destination = ob.OriginalTarget.NetAddr()
+			e.Outbound = ob.Tag
+			// a sniffed domain only used for routing is kept in RouteTarget
+			switch {
+			case ob.RouteTarget.Address != nil && ob.RouteTarget.Address.Family().IsDomain():
+				e.Domain = ob.RouteTarget.Address.Domain()
+			case ob.Target.Address != nil && ob.Target.Address.Family().IsDomain():
+				e.Domain = ob.Target.Address.Domain()
+			}
+		}
+		if content := session.ContentFromContext(l.ctx); content != nil {
+			e.Protocol = content.Protocol
+		}
+		l.logger.Write(e)
+	})
+}
+
+// logWriter counts the bytes of one direction of a logged link. The
+// downlink writer also writes the entry when it is closed.
+type logWriter struct {
+	writer  buf.Writer
+	counter *atomic.Int64
+	log     *linkLog
+	last    bool
+}
+
+func (w *logWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.counter.Add(int64(mb.Len()))
+	return w.writer.WriteMultiBuffer(mb)
+}
+
+func (w *logWriter) Close() error {
+	if w.last {
+		w.log.finish()
+	}
+	return common.Close(w.writer)
+}
+
+func (w *logWriter) Interrupt() {
+	if w.last {
+		w.log.finish()
+	}
+	common.Interrupt(w.writer)
+}
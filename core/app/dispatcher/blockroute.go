@@ -0,0 +1,42 @@
+package dispatcher
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/wyx2685/v2node/limiter"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+)
+
+const blockRulePrefix = "block-route-"
+
+// BlockRuleTag is the rule tag of the router rule built from the panel block
+// route id for the node tag. Panels share routes between nodes, so the tag
+// keeps the node to stay unique on the router.
+func BlockRuleTag(tag string, id int) string {
+	return blockRulePrefix + strconv.Itoa(id) + "@" + tag
+}
+
+// recordBlock queues a hit of the panel block route behind ruleTag for the
+// node of the inbound, other rules are ignored.
+func recordBlock(ctx context.Context, ruleTag string, destination net.Destination) {
+	if !strings.HasPrefix(ruleTag, blockRulePrefix) {
+		return
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(ruleTag, blockRulePrefix), "@")
+	routeID, err := strconv.Atoi(id)
+	if err != nil {
+		return
+	}
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil || inbound.User == nil || inbound.User.Email == "" {
+		return
+	}
+	limit, err := limiter.GetLimiter(inbound.Tag)
+	if err != nil {
+		return
+	}
+	limit.RecordHit(inbound.User.Email, limiter.HitRoute, routeID, destination.NetAddr())
+}
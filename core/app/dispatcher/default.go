@@ -7,9 +7,12 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/wyx2685/v2node/common/accesslog"
 	"github.com/wyx2685/v2node/common/counter"
+	"github.com/wyx2685/v2node/common/metrics"
 	"github.com/wyx2685/v2node/common/rate"
 	"github.com/wyx2685/v2node/limiter"
 
@@ -108,6 +111,8 @@ type DefaultDispatcher struct {
 	fdns         dns.FakeDNSEngine
 	Counter      sync.Map
 	LinkManagers sync.Map // map[string]*LinkManager
+	draining     sync.Map // tag -> map[string]struct{} of the sources still served, see Drain
+	accessLog    atomic.Pointer[accesslog.Logger]
 }
 
 func init() {
@@ -147,7 +152,80 @@ func (*DefaultDispatcher) Start() error {
 // Close implements common.Closable.
 func (*DefaultDispatcher) Close() error { return nil }
 
-func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*transport.Link, *transport.Link, *limiter.Limiter, error) {
+// ActiveLinks returns the number of user links whose dispatch has not ended,
+// a link counts until both its directions are done.
+func (d *DefaultDispatcher) ActiveLinks() int {
+	count := 0
+	d.LinkManagers.Range(func(_, value interface{}) bool {
+		count += value.(*LinkManager).Len()
+		return true
+	})
+	return count
+}
+
+// CloseAllLinks closes the links of all users.
+func (d *DefaultDispatcher) CloseAllLinks() {
+	d.LinkManagers.Range(func(_, value interface{}) bool {
+		value.(*LinkManager).CloseAll()
+		return true
+	})
+}
+
+// Drain stops new connections on the inbound tag while it is kept open for
+// the sessions it holds, as QUIC and UDP inbounds end them when removed. Only
+// the sources with a link open now may open more, so the streams of a QUIC
+// connection or the packets of a UDP session go on.
+func (d *DefaultDispatcher) Drain(tag string) {
+	sources := make(map[string]struct{})
+	d.LinkManagers.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), tag+"|") {
+			for _, s := range value.(*LinkManager).Sources() {
+				sources[s] = struct{}{}
+			}
+		}
+		return true
+	})
+	d.draining.Store(tag, sources)
+}
+
+// linkManager returns the link manager of the user email, adding it if needed.
+func (d *DefaultDispatcher) linkManager(email string) *LinkManager {
+	if lm, ok := d.LinkManagers.Load(email); ok {
+		return lm.(*LinkManager)
+	}
+	lm, _ := d.LinkManagers.LoadOrStore(email, &LinkManager{
+		links: make(map[*ManagedWriter]buf.Reader),
+	})
+	return lm.(*LinkManager)
+}
+
+// drainRefuses reports whether inbound is a new connection on a draining tag.
+func (d *DefaultDispatcher) drainRefuses(inbound *session.Inbound) bool {
+	if inbound == nil {
+		return false
+	}
+	v, ok := d.draining.Load(inbound.Tag)
+	if !ok {
+		return false
+	}
+	_, ok = v.(map[string]struct{})[inbound.Source.NetAddr()]
+	return !ok
+}
+
+// bannedSource reports whether the inbound comes from a banned ip. The
+// inbounds accept and authenticate connections inside xray-core, so a link
+// reaching the dispatcher is the first point v2node can refuse it; the check
+// runs before any user or limiter lookup.
+func bannedSource(inbound *session.Inbound) bool {
+	if inbound == nil || inbound.Source.Address == nil || !inbound.Source.Address.Family().IsIP() {
+		return false
+	}
+	return limiter.IsBanned(inbound.Source.Address.IP().String())
+}
+
+// getLink returns the links of a new dispatch. The managed writer is nil
+// unless the link belongs to a user, it is released when the dispatch ends.
+func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*transport.Link, *transport.Link, *limiter.Limiter, *ManagedWriter, error) {
 	opt := pipe.OptionsFromContext(ctx)
 	uplinkReader, uplinkWriter := pipe.New(opt...)
 	downlinkReader, downlinkWriter := pipe.New(opt...)
@@ -168,7 +246,25 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 		user = sessionInbound.User
 	}
 
+	if d.drainRefuses(sessionInbound) {
+		common.Close(outboundLink.Writer)
+		common.Close(inboundLink.Writer)
+		common.Interrupt(outboundLink.Reader)
+		common.Interrupt(inboundLink.Reader)
+		return nil, nil, nil, nil, errors.New("inbound ", sessionInbound.Tag, " is draining")
+	}
+
+	if bannedSource(sessionInbound) {
+		metrics.BanRejects.Inc(sessionInbound.Tag)
+		common.Close(outboundLink.Writer)
+		common.Close(inboundLink.Writer)
+		common.Interrupt(outboundLink.Reader)
+		common.Interrupt(inboundLink.Reader)
+		return nil, nil, nil, nil, errors.New("banned ip ", sessionInbound.Source.Address)
+	}
+
 	var limit *limiter.Limiter
+	var managedWriter *ManagedWriter
 	var err error
 	if user != nil && len(user.Email) > 0 {
 		limit, err = limiter.GetLimiter(sessionInbound.Tag)
@@ -178,40 +274,59 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 			common.Close(inboundLink.Writer)
 			common.Interrupt(outboundLink.Reader)
 			common.Interrupt(inboundLink.Reader)
-			return nil, nil, nil, errors.New("get limiter ", sessionInbound.Tag, " error: ", err)
+			return nil, nil, nil, nil, errors.New("get limiter ", sessionInbound.Tag, " error: ", err)
+		}
+		lm := d.linkManager(user.Email)
+		managedWriter = &ManagedWriter{
+			writer:  uplinkWriter,
+			manager: lm,
+			ip:      strings.TrimPrefix(sessionInbound.Source.Address.IP().String(), "::ffff:"),
+			source:  sessionInbound.Source.NetAddr(),
+			start:   time.Now(),
+			udp:     network == net.Network_UDP,
+		}
+		// the conn limit goes first, a refused link must not take a device
+		if !lm.TryAddLink(managedWriter, outboundLink.Reader, limit.UserConnLimit(user.Email)) {
+			errors.LogInfo(ctx, "Limited ", user.Email, " by conn count")
+			metrics.ConnLimitRejects.Inc(sessionInbound.Tag)
+			common.Close(outboundLink.Writer)
+			common.Close(inboundLink.Writer)
+			common.Interrupt(outboundLink.Reader)
+			common.Interrupt(inboundLink.Reader)
+			return nil, nil, nil, nil, errors.New("Limited ", user.Email, " by conn count")
 		}
 		// Speed Limit and Device Limit
-		w, reject := limit.CheckLimit(user.Email,
+		up, down, reject := limit.CheckLimit(user.Email,
 			sessionInbound.Source.Address.IP().String(),
 			network == net.Network_TCP,
 			sessionInbound.Source.Network == net.Network_TCP)
 		if reject {
 			errors.LogInfo(ctx, "Limited ", user.Email, " by conn or ip")
+			lm.RemoveWriter(managedWriter)
 			common.Close(outboundLink.Writer)
 			common.Close(inboundLink.Writer)
 			common.Interrupt(outboundLink.Reader)
 			common.Interrupt(inboundLink.Reader)
-			return nil, nil, nil, errors.New("Limited ", user.Email, " by conn or ip")
-		}
-		var lm *LinkManager
-		if lmloaded, ok := d.LinkManagers.Load(user.Email); !ok {
-			lm = &LinkManager{
-				links: make(map[*ManagedWriter]buf.Reader),
-			}
-			d.LinkManagers.Store(user.Email, lm)
-		} else {
-			lm = lmloaded.(*LinkManager)
-		}
-		managedWriter := &ManagedWriter{
-			writer:  uplinkWriter,
-			manager: lm,
+			return nil, nil, nil, nil, errors.New("Limited ", user.Email, " by conn or ip")
 		}
-		lm.AddLink(managedWriter, outboundLink.Reader)
 		inboundLink.Writer = managedWriter
-		if w != nil {
+		if up != nil || down != nil {
 			sessionInbound.CanSpliceCopy = 3
-			inboundLink.Writer = rate.NewRateLimitWriter(inboundLink.Writer, w)
-			outboundLink.Writer = rate.NewRateLimitWriter(outboundLink.Writer, w)
+		}
+		if up != nil {
+			inboundLink.Writer = rate.NewRateLimitWriter(inboundLink.Writer, up)
+		}
+		if down != nil {
+			outboundLink.Writer = rate.NewRateLimitWriter(outboundLink.Writer, down)
+		}
+		if q := limit.Quota(user.Email); q != nil {
+			qc := &quotaCounter{quota: q, cutOff: func() {
+				errors.LogInfo(ctx, "Quota of ", user.Email, " exhausted")
+				metrics.QuotaCutoffs.Inc(sessionInbound.Tag)
+				lm.CloseAll()
+			}}
+			inboundLink.Writer = &quotaWriter{writer: inboundLink.Writer, counter: qc}
+			outboundLink.Writer = &quotaWriter{writer: outboundLink.Writer, counter: qc}
 		}
 		var t *counter.TrafficCounter
 		if c, ok := d.Counter.Load(sessionInbound.Tag); !ok {
@@ -232,9 +347,13 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 			Counter: downcounter,
 			Writer:  outboundLink.Writer,
 		}
+		if ll := d.newLinkLog(ctx, limit.UserUID(user.Email), sessionInbound.Tag, managedWriter.ip); ll != nil {
+			inboundLink.Writer = &logWriter{writer: inboundLink.Writer, counter: &ll.up, log: ll}
+			outboundLink.Writer = &logWriter{writer: outboundLink.Writer, counter: &ll.down, log: ll, last: true}
+		}
 	}
 
-	return inboundLink, outboundLink, limit, nil
+	return inboundLink, outboundLink, limit, managedWriter, nil
 }
 
 func (d *DefaultDispatcher) shouldOverride(ctx context.Context, result SniffResult, request session.SniffingRequest, destination net.Destination) bool {
@@ -301,12 +420,17 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 		ctx = session.ContextWithContent(ctx, content)
 	}
 	sniffingRequest := content.SniffingRequest
-	inbound, outbound, _, err := d.getLink(ctx, destination.Network)
+	inbound, outbound, limit, managedWriter, err := d.getLink(ctx, destination.Network)
 	if err != nil {
 		return nil, err
 	}
 	if !sniffingRequest.Enabled {
-		go d.routedDispatch(ctx, outbound, destination)
+		go func() {
+			d.auditedDispatch(ctx, limit, outbound, destination)
+			if managedWriter != nil {
+				managedWriter.release()
+			}
+		}()
 	} else {
 		go func() {
 			cReader := &cachedReader{
@@ -335,7 +459,10 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 					ob.Target = destination
 				}
 			}
-			d.routedDispatch(ctx, outbound, destination)
+			d.auditedDispatch(ctx, limit, outbound, destination)
+			if managedWriter != nil {
+				managedWriter.release()
+			}
 		}()
 	}
 	return inbound, nil
@@ -366,7 +493,21 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 		user = sessionInbound.User
 	}
 
+	if d.drainRefuses(sessionInbound) {
+		common.Close(outbound.Writer)
+		common.Interrupt(outbound.Reader)
+		return errors.New("inbound ", sessionInbound.Tag, " is draining")
+	}
+
+	if bannedSource(sessionInbound) {
+		metrics.BanRejects.Inc(sessionInbound.Tag)
+		common.Close(outbound.Writer)
+		common.Interrupt(outbound.Reader)
+		return errors.New("banned ip ", sessionInbound.Source.Address)
+	}
+
 	var limit *limiter.Limiter
+	var managedWriter *ManagedWriter
 	var err error
 	if user != nil && len(user.Email) > 0 {
 		limit, err = limiter.GetLimiter(sessionInbound.Tag)
@@ -376,34 +517,53 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 			common.Interrupt(outbound.Reader)
 			return errors.New("get limiter ", sessionInbound.Tag, " error: ", err)
 		}
+		lm := d.linkManager(user.Email)
+		managedWriter = &ManagedWriter{
+			writer:  outbound.Writer,
+			manager: lm,
+			ip:      strings.TrimPrefix(sessionInbound.Source.Address.IP().String(), "::ffff:"),
+			source:  sessionInbound.Source.NetAddr(),
+			start:   time.Now(),
+			udp:     destination.Network == net.Network_UDP,
+		}
+		// the conn limit goes first, a refused link must not take a device
+		if !lm.TryAddLink(managedWriter, outbound.Reader, limit.UserConnLimit(user.Email)) {
+			errors.LogInfo(ctx, "Limited ", user.Email, " by conn count")
+			metrics.ConnLimitRejects.Inc(sessionInbound.Tag)
+			common.Close(outbound.Writer)
+			common.Interrupt(outbound.Reader)
+			return errors.New("Limited ", user.Email, " by conn count")
+		}
 		// Speed Limit and Device Limit
-		w, reject := limit.CheckLimit(user.Email,
+		up, down, reject := limit.CheckLimit(user.Email,
 			sessionInbound.Source.Address.IP().String(),
 			destination.Network == net.Network_TCP,
 			sessionInbound.Source.Network == net.Network_TCP)
 		if reject {
 			errors.LogInfo(ctx, "Limited ", user.Email, " by conn or ip")
+			lm.RemoveWriter(managedWriter)
 			common.Close(outbound.Writer)
 			common.Interrupt(outbound.Reader)
 			return errors.New("Limited ", user.Email, " by conn or ip")
 		}
-		var lm *LinkManager
-		if lmloaded, ok := d.LinkManagers.Load(user.Email); !ok {
-			lm = &LinkManager{
-				links: make(map[*ManagedWriter]buf.Reader),
-			}
-			d.LinkManagers.Store(user.Email, lm)
-		} else {
-			lm = lmloaded.(*LinkManager)
-		}
-		managedWriter := &ManagedWriter{
-			writer:  outbound.Writer,
-			manager: lm,
-		}
 		outbound.Writer = managedWriter
-		if w != nil {
+		if up != nil || down != nil {
 			sessionInbound.CanSpliceCopy = 3
-			outbound.Writer = rate.NewRateLimitWriter(outbound.Writer, w)
+		}
+		if down != nil {
+			outbound.Writer = rate.NewRateLimitWriter(outbound.Writer, down)
+		}
+		if up != nil {
+			outbound.Reader = rate.NewRateLimitReader(outbound.Reader, up)
+		}
+		if q := limit.Quota(user.Email); q != nil {
+			qc := &quotaCounter{quota: q, cutOff: func() {
+				errors.LogInfo(ctx, "Quota of ", user.Email, " exhausted")
+				metrics.QuotaCutoffs.Inc(sessionInbound.Tag)
+				lm.CloseAll()
+			}}
+			outbound.Writer = &quotaWriter{writer: outbound.Writer, counter: qc}
+			outbound.Reader = &quotaReader{reader: outbound.Reader, counter: qc}
 		}
 		var t *counter.TrafficCounter
 		if c, ok := d.Counter.Load(sessionInbound.Tag); !ok {
@@ -419,16 +579,23 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 			Reader:  &buf.TimeoutWrapperReader{Reader: outbound.Reader},
 			Counter: &ts.UpCounter,
 		}
-		lm.AddLink(managedWriter, outbound.Reader)
 		outbound.Writer = &dispatcher.SizeStatWriter{
 			Counter: downcounter,
 			Writer:  outbound.Writer,
 		}
+		if ll := d.newLinkLog(ctx, limit.UserUID(user.Email), sessionInbound.Tag, managedWriter.ip); ll != nil {
+			outbound.Reader = &CounterReader{Reader: outbound.Reader.(buf.TimeoutReader), Counter: &ll.up}
+			outbound.Writer = &logWriter{writer: outbound.Writer, counter: &ll.down, log: ll, last: true}
+		}
 	}
 
+	if managedWriter != nil {
+		// the outbound has finished both directions when the dispatch returns
+		defer managedWriter.release()
+	}
 	sniffingRequest := content.SniffingRequest
 	if !sniffingRequest.Enabled {
-		d.routedDispatch(ctx, outbound, destination)
+		d.auditedDispatch(ctx, limit, outbound, destination)
 	} else {
 		cReader := &cachedReader{
 			reader: outbound.Reader.(buf.TimeoutReader),
@@ -456,7 +623,7 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 				ob.Target = destination
 			}
 		}
-		d.routedDispatch(ctx, outbound, destination)
+		d.auditedDispatch(ctx, limit, outbound, destination)
 	}
 
 	return nil
@@ -518,6 +685,29 @@ func sniffer(ctx context.Context, cReader *cachedReader, metadataOnly bool, netw
 	return contentResult, contentErr
 }
 
+// auditedDispatch routes the link unless it hits an audit rule of its node,
+// in which case it is closed and the hit queued for the panel.
+func (d *DefaultDispatcher) auditedDispatch(ctx context.Context, limit *limiter.Limiter, link *transport.Link, destination net.Destination) {
+	if limit != nil {
+		user := session.InboundFromContext(ctx).User
+		var domain, protocol string
+		if destination.Address != nil && destination.Address.Family().IsDomain() {
+			domain = destination.Address.Domain()
+		}
+		if content := session.ContentFromContext(ctx); content != nil {
+			protocol = content.Protocol
+		}
+		if limit.Audit(user.Email, domain, protocol, destination.NetAddr()) {
+			errors.LogInfo(ctx, "Audit rule hit by ", user.Email, " to ", destination)
+			metrics.AuditHits.Inc(limit.Tag)
+			common.Close(link.Writer)
+			common.Interrupt(link.Reader)
+			return
+		}
+	}
+	d.routedDispatch(ctx, link, destination)
+}
+
 func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.Link, destination net.Destination) {
 	outbounds := session.OutboundsFromContext(ctx)
 	ob := outbounds[len(outbounds)-1]
@@ -548,6 +738,7 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 					errors.LogInfo(ctx, "taking detour [", outTag, "] for [", destination, "]")
 				} else {
 					errors.LogInfo(ctx, "Hit route rule: [", route.GetRuleTag(), "] so taking detour [", outTag, "] for [", destination, "]")
+					recordBlock(ctx, route.GetRuleTag(), destination)
 				}
 				handler = h
 			} else {
@@ -0,0 +1,157 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/format"
+	"github.com/wyx2685/v2node/limiter"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// sinkHandler is an outbound that reads the uplink to the end and reports how much it got.
+type sinkHandler struct {
+	outbound.Handler
+	got chan int32
+}
+
+func (h *sinkHandler) Tag() string { return "sink" }
+
+func (h *sinkHandler) Dispatch(_ context.Context, link *transport.Link) {
+	var n int32
+	for {
+		mb, err := link.Reader.ReadMultiBuffer()
+		n += mb.Len()
+		buf.ReleaseMulti(mb)
+		if err != nil {
+			break
+		}
+	}
+	common.Close(link.Writer)
+	h.got <- n
+}
+
+type sinkManager struct {
+	outbound.Manager
+	handler outbound.Handler
+}
+
+func (m *sinkManager) GetHandler(string) outbound.Handler  { return m.handler }
+func (m *sinkManager) GetDefaultHandler() outbound.Handler { return m.handler }
+
+// A hysteria2 user relays over DispatchLink, the upload has to be held to the user speed limit.
+func TestDispatchLinkThrottlesUpload(t *testing.T) {
+	const (
+		tag   = "hysteria2-test"
+		mbps  = 1
+		bytes = 375000 // 3s at 1 Mbps, the first second fills the bucket burst
+	)
+	limiter.Init()
+	limiter.AddLimiter(tag, []panel.UserInfo{{Id: 1, Uuid: "user", SpeedLimit: mbps}}, map[int]int{})
+	defer limiter.DeleteLimiter(tag)
+
+	sink := &sinkHandler{got: make(chan int32, 1)}
+	d := &DefaultDispatcher{ohm: &sinkManager{handler: sink}}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    tag,
+		Source: net.UDPDestination(net.ParseAddress("10.0.0.2"), 5000),
+		User:   &protocol.MemoryUser{Email: format.UserTag(tag, "user")},
+	})
+
+	upReader, upWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+	downReader, downWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+	go func() {
+		for sent := 0; sent < bytes; sent += buf.Size {
+			b := buf.New()
+			b.Extend(buf.Size)
+			if err := upWriter.WriteMultiBuffer(buf.MultiBuffer{b}); err != nil {
+				return
+			}
+		}
+		upWriter.Close()
+	}()
+	go func() {
+		for {
+			mb, err := downReader.ReadMultiBuffer()
+			buf.ReleaseMulti(mb)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	link := &transport.Link{Reader: upReader, Writer: downWriter}
+	if err := d.DispatchLink(ctx, net.UDPDestination(net.ParseAddress("1.1.1.1"), 443), link); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	got := <-sink.got
+
+	if got < bytes {
+		t.Fatalf("outbound got %d bytes, want %d", got, bytes)
+	}
+	rate := float64(mbps) * 1000000 / 8
+	// everything past the one second burst is paced at the limit
+	if want := time.Duration((float64(got) - rate) / rate * 0.9 * float64(time.Second)); elapsed < want {
+		t.Fatalf("%d bytes took %s, the %d Mbps limit needs at least %s", got, elapsed, mbps, want)
+	}
+	if v, ok := d.LinkManagers.Load(format.UserTag(tag, "user")); !ok || v.(*LinkManager).Len() != 0 {
+		t.Fatal("link not released after the dispatch ended")
+	}
+}
+
+// A user at the conn limit is refused without taking a device, and a link
+// ending frees its slot for the next one.
+func TestConnLimit(t *testing.T) {
+	const tag = "vless-connlimit"
+	limiter.Init()
+	l := limiter.AddLimiter(tag, []panel.UserInfo{{Id: 1, Uuid: "user", ConnLimit: 1}}, map[int]int{})
+	defer limiter.DeleteLimiter(tag)
+	email := format.UserTag(tag, "user")
+	d := &DefaultDispatcher{}
+	from := func(ip string) context.Context {
+		return session.ContextWithInbound(context.Background(), &session.Inbound{
+			Tag:    tag,
+			Source: net.TCPDestination(net.ParseAddress(ip), 40000),
+			User:   &protocol.MemoryUser{Email: email},
+		})
+	}
+
+	_, _, _, first, err := d.getLink(from("10.0.0.2"), net.Network_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := d.getLink(from("10.0.0.3"), net.Network_TCP); err == nil {
+		t.Fatal("link over the conn limit accepted")
+	}
+	if v, ok := l.UserOnlineIP.Load(email); ok {
+		if _, ok := v.(*sync.Map).Load("10.0.0.3"); ok {
+			t.Fatal("link refused by the conn limit is online")
+		}
+	}
+	lm := d.linkManager(email)
+	if lm.Len() != 1 {
+		t.Fatalf("%d links counted, want 1", lm.Len())
+	}
+
+	first.release()
+	if lm.Len() != 0 {
+		t.Fatalf("%d links counted after release, want 0", lm.Len())
+	}
+	_, _, _, next, err := d.getLink(from("10.0.0.3"), net.Network_TCP)
+	if err != nil {
+		t.Fatalf("link after release refused: %v", err)
+	}
+	next.release()
+}
@@ -1,7 +1,9 @@
 package dispatcher
 
 import (
+	"net/netip"
 	sync "sync"
+	"time"
 
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
@@ -10,39 +12,135 @@ import (
 type ManagedWriter struct {
 	writer  buf.Writer
 	manager *LinkManager
+	ip      string
+	source  string // ip and port of the connection the link came on
+	start   time.Time
+	udp     bool
+}
+
+// LinkInfo describes an open link of a user.
+type LinkInfo struct {
+	IP    string    `json:"ip"`
+	Start time.Time `json:"start"`
 }
 
 func (w *ManagedWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
 	return w.writer.WriteMultiBuffer(mb)
 }
 
+// Close closes the writer only. A closed writer is one half of the link
+// done, the link keeps its slot until the dispatch releases it.
 func (w *ManagedWriter) Close() error {
-	w.manager.RemoveWriter(w)
 	return common.Close(w.writer)
 }
 
+// release removes the link from its manager once both directions are done.
+func (w *ManagedWriter) release() {
+	w.manager.RemoveWriter(w)
+}
+
 type LinkManager struct {
 	links map[*ManagedWriter]buf.Reader
+	tcp   int
+	udp   int
 	mu    sync.RWMutex
 }
 
 func (m *LinkManager) AddLink(writer *ManagedWriter, reader buf.Reader) {
+	m.TryAddLink(writer, reader, 0)
+}
+
+// TryAddLink adds the link unless the user already has limit links of the
+// same network open. A limit of 0 is unlimited.
+func (m *LinkManager) TryAddLink(writer *ManagedWriter, reader buf.Reader, limit int) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	count := &m.tcp
+	if writer.udp {
+		count = &m.udp
+	}
+	if limit > 0 && *count >= limit {
+		return false
+	}
+	if _, ok := m.links[writer]; !ok {
+		*count++
+	}
 	m.links[writer] = reader
+	return true
 }
 
 func (m *LinkManager) RemoveWriter(writer *ManagedWriter) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, ok := m.links[writer]; !ok {
+		return
+	}
 	delete(m.links, writer)
+	if writer.udp {
+		m.udp--
+	} else {
+		m.tcp--
+	}
 }
 
+// CloseAll closes every link. The links are collected first and closed
+// without holding the lock, each leaves the manager when its dispatch ends.
 func (m *LinkManager) CloseAll() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	links := make(map[*ManagedWriter]buf.Reader, len(m.links))
+	for w, r := range m.links {
+		links[w] = r
+	}
+	m.mu.RUnlock()
+	for w, r := range links {
+		common.Close(w)
+		common.Interrupt(r)
+	}
+}
+
+// CloseIP closes the links from ip, an ipv4-mapped ipv6 address matches its ipv4 form.
+func (m *LinkManager) CloseIP(ip string) int {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		ip = addr.Unmap().String()
+	}
+	m.mu.RLock()
+	links := make(map[*ManagedWriter]buf.Reader)
 	for w, r := range m.links {
+		if w.ip == ip {
+			links[w] = r
+		}
+	}
+	m.mu.RUnlock()
+	for w, r := range links {
 		common.Close(w)
 		common.Interrupt(r)
 	}
+	return len(links)
+}
+
+func (m *LinkManager) Links() []LinkInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	links := make([]LinkInfo, 0, len(m.links))
+	for w := range m.links {
+		links = append(links, LinkInfo{IP: w.ip, Start: w.start})
+	}
+	return links
+}
+
+// Sources returns the source addresses of the open links.
+func (m *LinkManager) Sources() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sources := make([]string, 0, len(m.links))
+	for w := range m.links {
+		sources = append(sources, w.source)
+	}
+	return sources
+}
+
+func (m *LinkManager) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.links)
 }
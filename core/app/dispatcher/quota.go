@@ -0,0 +1,67 @@
+package dispatcher
+
+import (
+	"sync"
+
+	"github.com/wyx2685/v2node/limiter"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+)
+
+var errQuotaExhausted = errors.New("quota exhausted")
+
+// quotaCounter takes the traffic of a link from the user quota, and cuts
+// off every link of the user once it is used up.
+type quotaCounter struct {
+	quota  *limiter.Quota
+	cutOff func()
+	once   sync.Once
+}
+
+func (c *quotaCounter) consume(mb buf.MultiBuffer) bool {
+	if c.quota.Consume(int64(mb.Len())) {
+		return true
+	}
+	c.once.Do(func() { go c.cutOff() })
+	return false
+}
+
+type quotaWriter struct {
+	writer  buf.Writer
+	counter *quotaCounter
+}
+
+func (w *quotaWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	if !w.counter.consume(mb) {
+		buf.ReleaseMulti(mb)
+		return errQuotaExhausted
+	}
+	return w.writer.WriteMultiBuffer(mb)
+}
+
+func (w *quotaWriter) Close() error {
+	return common.Close(w.writer)
+}
+
+type quotaReader struct {
+	reader  buf.Reader
+	counter *quotaCounter
+}
+
+func (r *quotaReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.reader.ReadMultiBuffer()
+	if !mb.IsEmpty() && !r.counter.consume(mb) {
+		buf.ReleaseMulti(mb)
+		return nil, errQuotaExhausted
+	}
+	return mb, err
+}
+
+func (r *quotaReader) Interrupt() {
+	common.Interrupt(r.reader)
+}
+
+func (r *quotaReader) Close() error {
+	return common.Close(r.reader)
+}
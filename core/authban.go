@@ -0,0 +1,179 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wyx2685/v2node/common/metrics"
+	"github.com/wyx2685/v2node/conf"
+	"github.com/wyx2685/v2node/limiter"
+	applog "github.com/xtls/xray-core/app/log"
+	xlog "github.com/xtls/xray-core/common/log"
+	xnet "github.com/xtls/xray-core/common/net"
+)
+
+// authWatcher sits in front of the core log handler and counts the handshakes
+// the inbounds reject per source ip, banning an ip that fails too often.
+// vmess, vless, trojan and shadowsocks log a rejected access. hysteria2 and
+// tuic check users inside their quic servers and only log an "authentication
+// failed" error with the remote address, those are counted as well. A vless
+// request sent to a fallback is not a failure, it is served by the fallback
+// like any other visitor. Banned ips are refused by the dispatcher.
+type authWatcher struct {
+	next      xlog.Handler
+	threshold int
+	window    time.Duration
+	ban       time.Duration
+	mu        sync.Mutex
+	fails     map[string]*authFailures
+	lastPrune time.Time
+}
+
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+func newAuthWatcher(next xlog.Handler, c *conf.BanConfig) *authWatcher {
+	w := &authWatcher{
+		next:      next,
+		threshold: c.AuthFailures,
+		window:    time.Minute,
+		ban:       time.Hour,
+		fails:     make(map[string]*authFailures),
+		lastPrune: time.Now(),
+	}
+	if c.AuthWindow > 0 {
+		w.window = time.Duration(c.AuthWindow) * time.Second
+	}
+	if c.AuthBanTime > 0 {
+		w.ban = time.Duration(c.AuthBanTime) * time.Minute
+	}
+	return w
+}
+
+// watchAuthFailures puts an authWatcher in front of the log of the running
+// core, unwatchAuthFailures takes it out again when the core is closed.
+func (v *V2Core) watchAuthFailures() {
+	l, ok := v.Server.GetFeature((*applog.Instance)(nil)).(*applog.Instance)
+	if !ok {
+		return
+	}
+	v.authWatch = newAuthWatcher(l, &v.Config.BanConfig)
+	xlog.RegisterHandler(v.authWatch)
+}
+
+func (v *V2Core) unwatchAuthFailures() {
+	if v.authWatch != nil {
+		xlog.RegisterHandler(v.authWatch.next)
+		v.authWatch = nil
+	}
+}
+
+// Handle implements log.Handler.
+func (w *authWatcher) Handle(msg xlog.Message) {
+	var ip string
+	switch m := msg.(type) {
+	case *xlog.AccessMessage:
+		if m.Status == xlog.AccessRejected {
+			ip = sourceIP(m.From)
+		}
+	case *xlog.GeneralMessage:
+		ip = quicAuthFailure(fmt.Sprint(m.Content))
+	}
+	if ip != "" {
+		metrics.AuthFailures.Inc()
+		w.fail(ip)
+	}
+	w.next.Handle(msg)
+}
+
+// quicAuthFailure returns the remote ip of an authentication failure logged
+// by the hysteria2 or tuic server, or "" if the message is something else.
+func quicAuthFailure(content string) string {
+	if !strings.Contains(strings.ToLower(content), "authentication failed") {
+		return ""
+	}
+	for _, field := range strings.Fields(content) {
+		if addr, err := netip.ParseAddrPort(strings.TrimRight(field, ":,;")); err == nil {
+			return sourceIP(net.TCPAddrFromAddrPort(addr))
+		}
+	}
+	return ""
+}
+
+func (w *authWatcher) fail(ip string) {
+	if w.threshold <= 0 || limiter.IsBanned(ip) {
+		return
+	}
+	now := time.Now()
+	w.mu.Lock()
+	if now.Sub(w.lastPrune) > w.window {
+		for k, f := range w.fails {
+			if now.Sub(f.first) > w.window {
+				delete(w.fails, k)
+			}
+		}
+		w.lastPrune = now
+	}
+	f, ok := w.fails[ip]
+	if !ok || now.Sub(f.first) > w.window {
+		f = &authFailures{first: now}
+		w.fails[ip] = f
+	}
+	f.count++
+	count := f.count
+	if count >= w.threshold {
+		delete(w.fails, ip)
+	}
+	w.mu.Unlock()
+	if count < w.threshold {
+		return
+	}
+	reason := fmt.Sprintf("%d auth failures in %s", count, w.window)
+	if err := limiter.BanIP(ip, w.ban, reason, "auth"); err != nil {
+		log.WithFields(log.Fields{
+			"ip":  ip,
+			"err": err,
+		}).Error("Ban ip failed")
+		return
+	}
+	metrics.AuthBans.Inc()
+	log.WithFields(log.Fields{
+		"ip":  ip,
+		"ban": w.ban,
+	}).Warn("Banned ip for repeated auth failures")
+}
+
+// sourceIP returns the ip of the From of an access message or of a
+// connection, or "" if it has none. IPv4-mapped addresses are unmapped so
+// they match IPv4 bans.
+func sourceIP(from interface{}) string {
+	var ip net.IP
+	switch v := from.(type) {
+	case xnet.Destination:
+		if v.Address != nil && v.Address.Family().IsIP() {
+			ip = v.Address.IP()
+		}
+	case net.Addr:
+		host, _, err := net.SplitHostPort(v.String())
+		if err != nil {
+			host = v.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	addr = addr.Unmap()
+	if addr.IsLoopback() {
+		return ""
+	}
+	return addr.String()
+}
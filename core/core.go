@@ -5,6 +5,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/accesslog"
 	"github.com/wyx2685/v2node/conf"
 	"github.com/wyx2685/v2node/core/app/dispatcher"
 	_ "github.com/wyx2685/v2node/core/distro/all"
@@ -16,7 +17,6 @@ import (
 	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/features/routing"
 	coreConf "github.com/xtls/xray-core/infra/conf"
-	"google.golang.org/protobuf/proto"
 )
 
 type AddUsersParams struct {
@@ -34,6 +34,9 @@ type V2Core struct {
 	ihm        inbound.Manager
 	ohm        outbound.Manager
 	dispatcher *dispatcher.DefaultDispatcher
+	levels     *policyLevels
+	accessLog  *accesslog.Logger
+	authWatch  *authWatcher
 }
 
 type UserMap struct {
@@ -54,13 +57,22 @@ func New(config *conf.Conf) *V2Core {
 func (v *V2Core) Start(infos []*panel.NodeInfo) error {
 	v.access.Lock()
 	defer v.access.Unlock()
-	v.Server = getCore(v.Config, infos)
+	v.levels = newPolicyLevels(v.Config, infos)
+	v.Server = getCore(v.Config, infos, v.levels)
 	if err := v.Server.Start(); err != nil {
 		return err
 	}
 	v.ihm = v.Server.GetFeature(inbound.ManagerType()).(inbound.Manager)
 	v.ohm = v.Server.GetFeature(outbound.ManagerType()).(outbound.Manager)
 	v.dispatcher = v.Server.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	v.watchAuthFailures()
+	accessLog, err := accesslog.New(&v.Config.LogConfig.AccessJSON)
+	if err != nil {
+		log.WithField("err", err).Error("Open json access log failed")
+	} else if accessLog != nil {
+		v.accessLog = accessLog
+		v.dispatcher.SetAccessLog(accessLog)
+	}
 	return nil
 }
 
@@ -71,14 +83,38 @@ func (v *V2Core) Close() error {
 	v.ihm = nil
 	v.ohm = nil
 	v.dispatcher = nil
+	v.unwatchAuthFailures()
 	err := v.Server.Close()
+	if v.accessLog != nil {
+		v.accessLog.Close()
+		v.accessLog = nil
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func getCore(c *conf.Conf, infos []*panel.NodeInfo) *core.Instance {
+// ActiveLinks returns the number of user links still open on all inbounds.
+func (v *V2Core) ActiveLinks() int {
+	v.access.Lock()
+	defer v.access.Unlock()
+	if v.dispatcher == nil {
+		return 0
+	}
+	return v.dispatcher.ActiveLinks()
+}
+
+// CloseAllLinks closes every user link on all inbounds.
+func (v *V2Core) CloseAllLinks() {
+	v.access.Lock()
+	defer v.access.Unlock()
+	if v.dispatcher != nil {
+		v.dispatcher.CloseAllLinks()
+	}
+}
+
+func getCore(c *conf.Conf, infos []*panel.NodeInfo, levels *policyLevels) *core.Instance {
 	// Log Config
 	coreLogConfig := &coreConf.LogConfig{
 		LogLevel:  c.LogConfig.Level,
@@ -94,18 +130,10 @@ func getCore(c *conf.Conf, infos []*panel.NodeInfo) *core.Instance {
 	var inBoundConfig []*core.InboundHandlerConfig
 
 	// Policy config
-	levelPolicyConfig := &coreConf.Policy{
-		StatsUserUplink:   true,
-		StatsUserDownlink: true,
-		Handshake:         proto.Uint32(4),
-		ConnectionIdle:    proto.Uint32(120),
-		UplinkOnly:        proto.Uint32(2),
-		DownlinkOnly:      proto.Uint32(4),
-		BufferSize:        proto.Int32(128),
+	policyConfig, err := levels.build()
+	if err != nil {
+		log.WithField("err", err).Panic("failed to build policy config")
 	}
-	corePolicyConfig := &coreConf.PolicyConfig{}
-	corePolicyConfig.Levels = map[uint32]*coreConf.Policy{0: levelPolicyConfig}
-	policyConfig, _ := corePolicyConfig.Build()
 	// Build Xray conf
 	config := &core.Config{
 		App: []*serial.TypedMessage{
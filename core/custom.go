@@ -5,7 +5,6 @@ import (
 	"log"
 	"net"
 	"os"
-	"strings"
 
 	panel "github.com/wyx2685/v2node/api/v2board"
 	"github.com/xtls/xray-core/app/dns"
@@ -49,6 +48,46 @@ type LocalRouteConfig struct {
 	BlockCNNodes   []int  `json:"block_cn_nodes"` 
 }
 
+// loadLocalRoute 读取本地路由配置 /etc/v2node/route.json
+func loadLocalRoute() LocalRouteConfig {
+	localRouteFile := "/etc/v2node/route.json"
+	localRoute := LocalRouteConfig{DomainStrategy: "AsIs"}
+	if data, err := os.ReadFile(localRouteFile); err == nil {
+		if err := json.Unmarshal(data, &localRoute); err == nil {
+			log.Printf("[Route] 配置文件读取成功: %+v", localRoute)
+		} else {
+			log.Printf("[Route] 配置文件解析失败: %v", err)
+		}
+	}
+	return localRoute
+}
+
+// blockCN 判断节点是否在 block_cn_nodes 中
+func (r LocalRouteConfig) blockCN(id int) bool {
+	for _, targetID := range r.BlockCNNodes {
+		if id == targetID {
+			return true
+		}
+	}
+	return false
+}
+
+// blockCNRule 屏蔽来自中国 ip 的访问，ruleTag 用于热更新时移除
+func blockCNRule(tag string) json.RawMessage {
+	rule, _ := json.Marshal(map[string]interface{}{
+		"type":        "field",
+		"inboundTag":  []string{tag},
+		"source":      []string{"geoip:cn"},
+		"outboundTag": "block",
+		"ruleTag":     blockCNRuleTag(tag),
+	})
+	return rule
+}
+
+func blockCNRuleTag(tag string) string {
+	return "block-cn@" + tag
+}
+
 func GetCustomConfig(infos []*panel.NodeInfo) (*dns.Config, []*xray.OutboundHandlerConfig, *router.Config, error) {
 	// --- DNS 初始化 ---
 	queryStrategy := "UseIPv4v6"
@@ -79,15 +118,7 @@ func GetCustomConfig(infos []*panel.NodeInfo) (*dns.Config, []*xray.OutboundHand
 	}
 
 	// --- 1. 读取并解析本地路由配置 ---
-	localRouteFile := "/etc/v2node/route.json"
-	localRoute := LocalRouteConfig{DomainStrategy: "AsIs"}
-	if data, err := os.ReadFile(localRouteFile); err == nil {
-		if err := json.Unmarshal(data, &localRoute); err == nil {
-			log.Printf("[Route] 配置文件读取成功: %+v", localRoute)
-		} else {
-			log.Printf("[Route] 配置文件解析失败: %v", err)
-		}
-	}
+	localRoute := loadLocalRoute()
 
 	// --- 2. 初始化 Outbound 和 Router ---
 	defaultoutbound, _ := buildDefaultOutbound()
@@ -112,66 +143,22 @@ func GetCustomConfig(infos []*panel.NodeInfo) (*dns.Config, []*xray.OutboundHand
 		// 打印每个检测到的节点 ID，用于调试排查
 		log.Printf("[Route] 检测到可用节点: Id=%d, Tag=%s", info.Id, info.Tag)
 		
-		isMatch := false
-		for _, targetID := range localRoute.BlockCNNodes {
-			if info.Id == targetID {
-				isMatch = true
-				break
-			}
-		}
-
-		if isMatch {
-			blockRule := map[string]interface{}{
-				"type":        "field",
-				"inboundTag":  []string{info.Tag}, 
-				"source":      []string{"geoip:cn"},
-				"outboundTag": "block",
-			}
-			rawBlockRule, _ := json.Marshal(blockRule)
+		if localRoute.blockCN(info.Id) {
 			// 注入到最前端
-			coreRouterConfig.RuleList = append([]json.RawMessage{rawBlockRule}, coreRouterConfig.RuleList...)
+			coreRouterConfig.RuleList = append([]json.RawMessage{blockCNRule(info.Tag)}, coreRouterConfig.RuleList...)
 			log.Printf("[Route] 命中拦截规则！已为 Id %d 注入 [geoip:cn -> block] 路由", info.Id)
 		}
 	}
 
 	// --- 4. 处理面板路由逻辑 ---
 	for _, info := range infos {
-		if len(info.Common.Routes) == 0 { continue }
-		for _, route := range info.Common.Routes {
-			switch route.Action {
-			case "dns":
-				if route.ActionValue == nil { continue }
-				coreDnsConfig.Servers = append(coreDnsConfig.Servers, &coreConf.NameServerConfig{
-					Address: &coreConf.Address{Address: xnet.ParseAddress(*route.ActionValue)},
-					Domains: route.Match,
-				})
-			case "block", "block_ip", "block_port", "protocol":
-				rule := map[string]interface{}{
-					"inboundTag": []string{info.Tag}, "outboundTag": "block",
-				}
-				if route.Action == "block" { rule["domain"] = route.Match }
-				if route.Action == "block_ip" { rule["ip"] = route.Match }
-				if route.Action == "block_port" { rule["port"] = strings.Join(route.Match, ",") }
-				if route.Action == "protocol" { rule["protocol"] = route.Match }
-				raw, _ := json.Marshal(rule)
-				coreRouterConfig.RuleList = append(coreRouterConfig.RuleList, raw)
-			case "route", "route_ip", "default_out":
-				if route.ActionValue == nil { continue }
-				outbound := &coreConf.OutboundDetourConfig{}
-				if err := json.Unmarshal([]byte(*route.ActionValue), outbound); err == nil {
-					rule := map[string]interface{}{
-						"inboundTag": []string{info.Tag}, "outboundTag": outbound.Tag,
-					}
-					if route.Action == "route" { rule["domain"] = route.Match }
-					if route.Action == "route_ip" { rule["ip"] = route.Match }
-					if route.Action == "default_out" { rule["network"] = "tcp,udp" }
-					raw, _ := json.Marshal(rule)
-					coreRouterConfig.RuleList = append(coreRouterConfig.RuleList, raw)
-					if !hasOutboundWithTag(coreOutboundConfig, outbound.Tag) {
-						if custom, err := outbound.Build(); err == nil {
-							coreOutboundConfig = append(coreOutboundConfig, custom)
-						}
-					}
+		rules, _, outbounds, servers := nodeRoutes(info)
+		coreDnsConfig.Servers = append(coreDnsConfig.Servers, servers...)
+		coreRouterConfig.RuleList = append(coreRouterConfig.RuleList, rules...)
+		for _, outbound := range outbounds {
+			if !hasOutboundWithTag(coreOutboundConfig, outbound.Tag) {
+				if custom, err := outbound.Build(); err == nil {
+					coreOutboundConfig = append(coreOutboundConfig, custom)
 				}
 			}
 		}
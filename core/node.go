@@ -25,3 +25,13 @@ func (v *V2Core) DelNode(tag string) error {
 	}
 	return nil
 }
+
+// DrainNode stops new connections on the node tag but keeps its inbound and
+// the sessions it holds, until DelNode removes it.
+func (v *V2Core) DrainNode(tag string) {
+	v.access.Lock()
+	defer v.access.Unlock()
+	if v.dispatcher != nil {
+		v.dispatcher.Drain(tag)
+	}
+}
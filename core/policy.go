@@ -0,0 +1,85 @@
+package core
+
+import (
+	"reflect"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/conf"
+	"github.com/xtls/xray-core/app/policy"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/protobuf/proto"
+)
+
+var defaultPolicy = conf.PolicyConfig{
+	Handshake:    proto.Uint32(4),
+	ConnIdle:     proto.Uint32(120),
+	UplinkOnly:   proto.Uint32(2),
+	DownlinkOnly: proto.Uint32(4),
+	BufferSize:   proto.Int32(128),
+}
+
+// policyLevels maps node tags to core policy levels. Level 0 is the global
+// policy, every distinct node policy gets a level of its own.
+type policyLevels struct {
+	policies []conf.PolicyConfig
+	tags     map[string]uint32
+}
+
+func newPolicyLevels(c *conf.Conf, infos []*panel.NodeInfo) *policyLevels {
+	l := &policyLevels{
+		policies: []conf.PolicyConfig{defaultPolicy.Merge(c.PolicyConfig)},
+		tags:     make(map[string]uint32),
+	}
+	for _, info := range infos {
+		p := l.policies[0].Merge(info.Policy)
+		level := -1
+		for i := range l.policies {
+			if reflect.DeepEqual(l.policies[i], p) {
+				level = i
+				break
+			}
+		}
+		if level < 0 {
+			level = len(l.policies)
+			l.policies = append(l.policies, p)
+		}
+		if level > 0 {
+			l.tags[info.Tag] = uint32(level)
+		}
+	}
+	return l
+}
+
+func (l *policyLevels) build() (*policy.Config, error) {
+	levels := make(map[uint32]*coreConf.Policy, len(l.policies))
+	for i, p := range l.policies {
+		levels[uint32(i)] = &coreConf.Policy{
+			StatsUserUplink:   true,
+			StatsUserDownlink: true,
+			Handshake:         p.Handshake,
+			ConnectionIdle:    p.ConnIdle,
+			UplinkOnly:        p.UplinkOnly,
+			DownlinkOnly:      p.DownlinkOnly,
+			BufferSize:        p.BufferSize,
+		}
+	}
+	return (&coreConf.PolicyConfig{Levels: levels}).Build()
+}
+
+func (l *policyLevels) level(tag string) uint32 {
+	if l == nil {
+		return 0
+	}
+	return l.tags[tag]
+}
+
+// PolicyApplied reports whether the running core already has the policy
+// level info needs. Levels can't be added at runtime, so when it has not
+// the core must be restarted.
+func (v *V2Core) PolicyApplied(info *panel.NodeInfo) bool {
+	if v.levels == nil {
+		return false
+	}
+	p := v.levels.policies[0].Merge(info.Policy)
+	return reflect.DeepEqual(v.levels.policies[v.levels.level(info.Tag)], p)
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/core/app/dispatcher"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/protobuf/proto"
+)
+
+// routeRuleTag is the rule tag of the router rule built from the panel route id for the node tag.
+func routeRuleTag(tag string, id int) string {
+	return fmt.Sprintf("route-%d@%s", id, tag)
+}
+
+// nodeRoutes builds the panel routes of info: the router rules with their
+// tags, the outbounds the rules send to, and the name servers of dns routes.
+func nodeRoutes(info *panel.NodeInfo) (rules []json.RawMessage, tags []string, outbounds []*coreConf.OutboundDetourConfig, servers []*coreConf.NameServerConfig) {
+	for _, route := range info.Common.Routes {
+		switch route.Action {
+		case "dns":
+			if route.ActionValue == nil {
+				continue
+			}
+			servers = append(servers, &coreConf.NameServerConfig{
+				Address: &coreConf.Address{Address: xnet.ParseAddress(*route.ActionValue)},
+				Domains: route.Match,
+			})
+		case "block", "block_ip", "block_port", "protocol":
+			tag := dispatcher.BlockRuleTag(info.Tag, route.Id)
+			rule := map[string]interface{}{
+				"inboundTag": []string{info.Tag}, "outboundTag": "block",
+				"ruleTag": tag,
+			}
+			switch route.Action {
+			case "block":
+				rule["domain"] = route.Match
+			case "block_ip":
+				rule["ip"] = route.Match
+			case "block_port":
+				rule["port"] = strings.Join(route.Match, ",")
+			case "protocol":
+				rule["protocol"] = route.Match
+			}
+			raw, _ := json.Marshal(rule)
+			rules = append(rules, raw)
+			tags = append(tags, tag)
+		case "route", "route_ip", "default_out":
+			if route.ActionValue == nil {
+				continue
+			}
+			outbound := &coreConf.OutboundDetourConfig{}
+			if err := json.Unmarshal([]byte(*route.ActionValue), outbound); err != nil {
+				continue
+			}
+			tag := routeRuleTag(info.Tag, route.Id)
+			rule := map[string]interface{}{
+				"inboundTag": []string{info.Tag}, "outboundTag": outbound.Tag,
+				"ruleTag": tag,
+			}
+			switch route.Action {
+			case "route":
+				rule["domain"] = route.Match
+			case "route_ip":
+				rule["ip"] = route.Match
+			case "default_out":
+				rule["network"] = "tcp,udp"
+			}
+			raw, _ := json.Marshal(rule)
+			rules = append(rules, raw)
+			tags = append(tags, tag)
+			outbounds = append(outbounds, outbound)
+		}
+	}
+	return rules, tags, outbounds, servers
+}
+
+func dnsRoutes(info *panel.NodeInfo) []panel.Route {
+	var routes []panel.Route
+	if info == nil {
+		return nil
+	}
+	for _, route := range info.Common.Routes {
+		if route.Action == "dns" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func builtinOutbound(tag string) bool {
+	return tag == "Default" || tag == "block" || tag == "dns_out"
+}
+
+// outboundChanged reports whether the running outbound h differs from config.
+func outboundChanged(h outbound.Handler, config *core.OutboundHandlerConfig) bool {
+	return !sameSettings(h.ProxySettings(), config.ProxySettings) ||
+		!sameSettings(h.SenderSettings(), config.SenderSettings)
+}
+
+func sameSettings(a, b *serial.TypedMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	am, err := a.GetInstance()
+	if err != nil {
+		return false
+	}
+	bm, err := b.GetInstance()
+	if err != nil {
+		return false
+	}
+	return proto.Equal(am, bm)
+}
+
+// DNSRoutesChanged reports whether the dns routes of a node differ between
+// old and new. They are compiled into the name servers of the core, which
+// can't be changed while it runs, so a change needs a core restart.
+func DNSRoutesChanged(old, new *panel.NodeInfo) bool {
+	return !reflect.DeepEqual(dnsRoutes(old), dnsRoutes(new))
+}
+
+// BlockCN reports whether the node id is listed in block_cn_nodes of route.json.
+func BlockCN(id int) bool {
+	return loadLocalRoute().blockCN(id)
+}
+
+// RoutesNeedReload reports whether the routes of a node that is not part of
+// the running core can only be added by restarting it. Dns routes are
+// compiled into the name servers, and the geoip:cn block of route.json has
+// to come before every other rule, while the router can only append them.
+func RoutesNeedReload(info *panel.NodeInfo) bool {
+	return len(dnsRoutes(info)) > 0 || BlockCN(info.Id)
+}
+
+// UpdateRoutes replaces the router rules of the node old with those of new
+// on the running core, adding the outbounds the new rules need and replacing
+// those whose settings changed under the same tag. Either may
+// be nil, for a node that is added or removed. Dns routes and the geoip:cn
+// block are left alone, see RoutesNeedReload.
+func (v *V2Core) UpdateRoutes(old, new *panel.NodeInfo) error {
+	v.access.Lock()
+	defer v.access.Unlock()
+	router, ok := v.Server.GetFeature(routing.RouterType()).(routing.Router)
+	if !ok {
+		return fmt.Errorf("router not found")
+	}
+	var rules []json.RawMessage
+	var remove, tags []string
+	var outbounds []*coreConf.OutboundDetourConfig
+	if old != nil {
+		_, remove, _, _ = nodeRoutes(old)
+	}
+	if new != nil {
+		rules, tags, outbounds, _ = nodeRoutes(new)
+	}
+	// a geoip:cn block can't be added back, keep it if it still applies
+	if old != nil && (new == nil || new.Tag != old.Tag || !BlockCN(new.Id)) {
+		remove = append(remove, blockCNRuleTag(old.Tag))
+	}
+	// the new tags too, in case an earlier update added them and failed later
+	for _, tag := range append(remove, tags...) {
+		router.RemoveRule(tag)
+	}
+	for _, o := range outbounds {
+		config, err := o.Build()
+		if err != nil {
+			return fmt.Errorf("build outbound %s error: %s", o.Tag, err)
+		}
+		if h := v.ohm.GetHandler(o.Tag); h != nil {
+			// the built in outbounds win over panel ones, as in GetCustomConfig
+			if builtinOutbound(o.Tag) || !outboundChanged(h, config) {
+				continue
+			}
+			if err := v.ohm.RemoveHandler(context.Background(), o.Tag); err != nil {
+				return fmt.Errorf("remove outbound %s error: %s", o.Tag, err)
+			}
+		}
+		if err := core.AddOutboundHandler(v.Server, config); err != nil {
+			return fmt.Errorf("add outbound %s error: %s", o.Tag, err)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	config, err := (&coreConf.RouterConfig{RuleList: rules}).Build()
+	if err != nil {
+		return fmt.Errorf("build route rules error: %s", err)
+	}
+	if err := router.AddRule(serial.ToTypedMessage(config), true); err != nil {
+		return fmt.Errorf("add route rules error: %s", err)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	panel "github.com/wyx2685/v2node/api/v2board"
 	"github.com/wyx2685/v2node/common/counter"
 	"github.com/wyx2685/v2node/common/format"
+	"github.com/wyx2685/v2node/common/metrics"
 	"github.com/wyx2685/v2node/core/app/dispatcher"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
@@ -84,12 +85,15 @@ func (vc *V2Core) GetUserTrafficSlice(tag string, mintraffic int) ([]panel.UserT
 			up := traffic.UpCounter.Load()
 			down := traffic.DownCounter.Load()
 			if up+down > int64(mintraffic*1000) {
-				traffic.UpCounter.Store(0)
-				traffic.DownCounter.Store(0)
+				// swap so bytes counted between load and reset are not lost
+				up = traffic.UpCounter.Swap(0)
+				down = traffic.DownCounter.Swap(0)
 				if vc.users.uidMap[email] == 0 {
 					c.Delete(email)
 					return true
 				}
+				metrics.TrafficBytes.Add(float64(up), tag, "up")
+				metrics.TrafficBytes.Add(float64(down), tag, "down")
 				trafficSlice = append(trafficSlice, panel.UserTraffic{
 					UID:      vc.users.uidMap[email],
 					Upload:   up,
@@ -106,6 +110,107 @@ func (vc *V2Core) GetUserTrafficSlice(tag string, mintraffic int) ([]panel.UserT
 	return nil, nil
 }
 
+// PeekUserTraffic returns the traffic counted for each user of tag since the
+// last report, without resetting the counters.
+func (vc *V2Core) PeekUserTraffic(tag string) []panel.UserTraffic {
+	var trafficSlice []panel.UserTraffic
+	vc.access.Lock()
+	defer vc.access.Unlock()
+	if vc.dispatcher == nil {
+		return nil
+	}
+	vc.users.mapLock.RLock()
+	defer vc.users.mapLock.RUnlock()
+	if v, ok := vc.dispatcher.Counter.Load(tag); ok {
+		v.(*counter.TrafficCounter).Counters.Range(func(key, value interface{}) bool {
+			traffic := value.(*counter.TrafficStorage)
+			if uid := vc.users.uidMap[key.(string)]; uid != 0 {
+				trafficSlice = append(trafficSlice, panel.UserTraffic{
+					UID:      uid,
+					Upload:   traffic.UpCounter.Load(),
+					Download: traffic.DownCounter.Load(),
+				})
+			}
+			return true
+		})
+	}
+	return trafficSlice
+}
+
+// KickUser closes the links of the user uid on tag, or on every tag if tag is
+// empty. If ip is set only the links from that source ip are closed.
+// It returns the number of links closed.
+func (vc *V2Core) KickUser(tag string, uid int, ip string) int {
+	vc.access.Lock()
+	defer vc.access.Unlock()
+	if vc.dispatcher == nil {
+		return 0
+	}
+	var emails []string
+	vc.users.mapLock.RLock()
+	for email, id := range vc.users.uidMap {
+		if id == uid && (tag == "" || strings.HasPrefix(email, tag+"|")) {
+			emails = append(emails, email)
+		}
+	}
+	vc.users.mapLock.RUnlock()
+	closed := 0
+	for _, email := range emails {
+		if v, ok := vc.dispatcher.LinkManagers.Load(email); ok {
+			lm := v.(*dispatcher.LinkManager)
+			if ip != "" {
+				closed += lm.CloseIP(ip)
+				continue
+			}
+			closed += lm.Len()
+			lm.CloseAll()
+		}
+	}
+	return closed
+}
+
+// UserLinks returns the open links of the user uid on tag.
+func (vc *V2Core) UserLinks(tag string, uid int) []dispatcher.LinkInfo {
+	var links []dispatcher.LinkInfo
+	vc.access.Lock()
+	defer vc.access.Unlock()
+	if vc.dispatcher == nil {
+		return nil
+	}
+	vc.users.mapLock.RLock()
+	defer vc.users.mapLock.RUnlock()
+	for email, id := range vc.users.uidMap {
+		if id != uid || !strings.HasPrefix(email, tag+"|") {
+			continue
+		}
+		if v, ok := vc.dispatcher.LinkManagers.Load(email); ok {
+			links = append(links, v.(*dispatcher.LinkManager).Links()...)
+		}
+	}
+	return links
+}
+
+// LinkIPs returns the source ips of the open links on tag by user email.
+func (vc *V2Core) LinkIPs(tag string) map[string][]string {
+	ips := make(map[string][]string)
+	vc.access.Lock()
+	defer vc.access.Unlock()
+	if vc.dispatcher == nil {
+		return ips
+	}
+	vc.dispatcher.LinkManagers.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		if !strings.HasPrefix(email, tag+"|") {
+			return true
+		}
+		for _, link := range value.(*dispatcher.LinkManager).Links() {
+			ips[email] = append(ips[email], link.IP)
+		}
+		return true
+	})
+	return ips
+}
+
 func (v *V2Core) AddUsers(p *AddUsersParams) (added int, err error) {
 	v.users.mapLock.Lock()
 	defer v.users.mapLock.Unlock()
@@ -138,7 +243,9 @@ func (v *V2Core) AddUsers(p *AddUsersParams) (added int, err error) {
 	if err != nil {
 		return 0, fmt.Errorf("get user manager error: %s", err)
 	}
+	level := v.levels.level(p.Tag)
 	for _, u := range users {
+		u.Level = level
 		mUser, err := u.ToMemoryUser()
 		if err != nil {
 			return 0, err
@@ -0,0 +1,137 @@
+package limiter
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	panel "github.com/wyx2685/v2node/api/v2board"
+)
+
+const maxAuditEvents = 10000
+
+// Kinds of audit events.
+const (
+	HitRule  = "rule"  // an audit rule rejected the link
+	HitRoute = "route" // a block route of the panel caught the link
+)
+
+// DomainRule rejects links to the domains matching Pattern.
+type DomainRule struct {
+	ID      int
+	Pattern *regexp.Regexp
+}
+
+// ProtocolRule rejects links sniffed as Protocol.
+type ProtocolRule struct {
+	ID       int
+	Protocol string
+}
+
+// SetAuditRules replaces the audit rules of the node, skipping invalid ones.
+func (l *Limiter) SetAuditRules(rules []panel.AuditRule) {
+	var domains []DomainRule
+	var protocols []ProtocolRule
+	for _, r := range rules {
+		switch r.Type {
+		case "domain":
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"tag":  l.Tag,
+					"rule": r.Id,
+					"err":  err,
+				}).Warn("Ignore invalid audit rule")
+				continue
+			}
+			domains = append(domains, DomainRule{ID: r.Id, Pattern: re})
+		case "protocol":
+			protocols = append(protocols, ProtocolRule{ID: r.Id, Protocol: strings.ToLower(r.Pattern)})
+		default:
+			log.WithFields(log.Fields{
+				"tag":  l.Tag,
+				"rule": r.Id,
+			}).Warnf("Ignore audit rule of unknown type %s", r.Type)
+		}
+	}
+	l.auditLock.Lock()
+	l.DomainRules = domains
+	l.ProtocolRules = protocols
+	l.auditLock.Unlock()
+}
+
+// Audit reports whether a link of the user to domain, sniffed as protocol,
+// hits an audit rule. A hit is queued for the next report with target.
+func (l *Limiter) Audit(taguuid, domain, protocol, target string) bool {
+	id, hit := l.matchAudit(domain, protocol)
+	if hit {
+		l.RecordHit(taguuid, HitRule, id, target)
+	}
+	return hit
+}
+
+// RecordHit queues a hit of the user on the audit rule or block route id.
+func (l *Limiter) RecordHit(taguuid, kind string, id int, target string) {
+	l.AddAuditEvent(panel.AuditEvent{
+		Type:   kind,
+		UID:    l.UserUID(taguuid),
+		RuleID: id,
+		Target: target,
+		Time:   time.Now().Unix(),
+	})
+}
+
+func (l *Limiter) matchAudit(domain, protocol string) (int, bool) {
+	l.auditLock.RLock()
+	defer l.auditLock.RUnlock()
+	if domain != "" {
+		for _, r := range l.DomainRules {
+			if r.Pattern.MatchString(domain) {
+				return r.ID, true
+			}
+		}
+	}
+	if protocol != "" {
+		protocol = strings.ToLower(protocol)
+		for _, r := range l.ProtocolRules {
+			if r.Protocol == protocol {
+				return r.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// AddAuditEvent queues e for the next report, dropping the oldest events
+// once maxAuditEvents are waiting.
+func (l *Limiter) AddAuditEvent(e panel.AuditEvent) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	if len(l.auditEvents) >= maxAuditEvents {
+		l.auditEvents = l.auditEvents[1:]
+	}
+	l.auditEvents = append(l.auditEvents, e)
+}
+
+// RequeueAuditEvents puts back events taken for a report that failed, ahead
+// of the events queued since and in their original order. The oldest events
+// are dropped beyond maxAuditEvents.
+func (l *Limiter) RequeueAuditEvents(events []panel.AuditEvent) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	queue := append(append(make([]panel.AuditEvent, 0, len(events)+len(l.auditEvents)), events...), l.auditEvents...)
+	if len(queue) > maxAuditEvents {
+		queue = queue[len(queue)-maxAuditEvents:]
+	}
+	l.auditEvents = queue
+}
+
+// TakeAuditEvents returns the queued events and clears the queue.
+func (l *Limiter) TakeAuditEvents() []panel.AuditEvent {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	events := l.auditEvents
+	l.auditEvents = nil
+	return events
+}
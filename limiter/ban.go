@@ -0,0 +1,339 @@
+package limiter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultBanFile = "/etc/v2node/bans.json"
+
+// saveDelay batches the changes of a burst of bans into one file write.
+const saveDelay = time.Second
+
+// Ban refuses every connection from an ip or cidr until it expires.
+type Ban struct {
+	CIDR   string `json:"cidr"`
+	Until  int64  `json:"until,omitempty"` // unix time, 0 never expires
+	Reason string `json:"reason,omitempty"`
+	Source string `json:"source,omitempty"` // who added it, e.g. admin or panel:<node>
+}
+
+func (b *Ban) expired(now int64) bool {
+	return b.Until != 0 && b.Until < now
+}
+
+// banList holds the bans of the host. It is shared by every node and kept
+// in a file, so bans survive a restart. A prefix keeps one ban per source,
+// so the sources never overwrite or lift each other's bans.
+type banList struct {
+	mu      sync.RWMutex
+	path    string
+	bans    map[netip.Prefix]map[string]Ban // prefix -> source -> ban
+	bits    map[int]int                     // prefix length -> prefixes using it, to look up only those
+	saving  *time.Timer                     // pending write of the file
+	writeMu sync.Mutex                      // orders the file writes, taken before mu is released
+}
+
+var bans = &banList{
+	bans: make(map[netip.Prefix]map[string]Ban),
+	bits: make(map[int]int),
+}
+
+// parsePrefix accepts an ip or a cidr.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// LoadBans reads the ban list from path, or the default file if empty.
+// A missing file gives an empty list. Pending changes of the current list
+// are written first, so reloading the same file keeps them.
+func LoadBans(path string) error {
+	bans.flush()
+	if path == "" {
+		path = defaultBanFile
+	}
+	var list []Ban
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read ban list error: %s", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return fmt.Errorf("decode ban list error: %s", err)
+		}
+	}
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	bans.path = path
+	bans.bans = make(map[netip.Prefix]map[string]Ban, len(list))
+	bans.bits = make(map[int]int)
+	now := time.Now().Unix()
+	for _, ban := range list {
+		p, err := parsePrefix(ban.CIDR)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cidr": ban.CIDR,
+				"err":  err,
+			}).Warn("Ignore invalid ban")
+			continue
+		}
+		if ban.expired(now) {
+			continue
+		}
+		ban.CIDR = p.String()
+		bans.put(p, ban)
+	}
+	return nil
+}
+
+// put stores ban under p and its source, the caller holds bans.mu.
+func (l *banList) put(p netip.Prefix, ban Ban) {
+	m, ok := l.bans[p]
+	if !ok {
+		m = make(map[string]Ban, 1)
+		l.bans[p] = m
+		l.bits[p.Bits()]++
+	}
+	m[ban.Source] = ban
+}
+
+// remove drops the ban source put on p, the caller holds bans.mu.
+func (l *banList) remove(p netip.Prefix, source string) bool {
+	m, ok := l.bans[p]
+	if !ok {
+		return false
+	}
+	if _, ok := m[source]; !ok {
+		return false
+	}
+	delete(m, source)
+	if len(m) == 0 {
+		l.removeAll(p)
+	}
+	return true
+}
+
+// removeAll drops every ban of p, the caller holds bans.mu.
+func (l *banList) removeAll(p netip.Prefix) bool {
+	if _, ok := l.bans[p]; !ok {
+		return false
+	}
+	delete(l.bans, p)
+	if l.bits[p.Bits()]--; l.bits[p.Bits()] == 0 {
+		delete(l.bits, p.Bits())
+	}
+	return true
+}
+
+// prune drops the expired bans, the caller holds bans.mu.
+func (l *banList) prune() {
+	now := time.Now().Unix()
+	for p, m := range l.bans {
+		for source, ban := range m {
+			if ban.expired(now) {
+				l.remove(p, source)
+			}
+		}
+	}
+}
+
+// save schedules a write of the ban list to its file, the caller holds
+// bans.mu. The file is written by flush outside the lock, so lookups never
+// wait on the disk.
+func (l *banList) save() {
+	if l.path == "" || l.saving != nil {
+		return
+	}
+	l.saving = time.AfterFunc(saveDelay, l.flush)
+}
+
+// flush writes a pending save of the ban list right away.
+func (l *banList) flush() {
+	l.mu.Lock()
+	if l.saving == nil {
+		l.mu.Unlock()
+		return
+	}
+	l.saving.Stop()
+	l.saving = nil
+	l.prune()
+	path, list := l.path, l.list()
+	l.writeMu.Lock()
+	l.mu.Unlock()
+	defer l.writeMu.Unlock()
+	err := func() error {
+		b, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, b, 0600); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, path)
+	}()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"err":  err,
+		}).Error("Save ban list failed")
+	}
+}
+
+// SaveBans writes the ban changes not in the file yet, call it before exit.
+func SaveBans() {
+	bans.flush()
+}
+
+// list returns the bans sorted by cidr and source, the caller holds bans.mu.
+func (l *banList) list() []Ban {
+	list := make([]Ban, 0, len(l.bans))
+	now := time.Now().Unix()
+	for _, m := range l.bans {
+		for _, ban := range m {
+			if !ban.expired(now) {
+				list = append(list, ban)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CIDR != list[j].CIDR {
+			return list[i].CIDR < list[j].CIDR
+		}
+		return list[i].Source < list[j].Source
+	})
+	return list
+}
+
+// BanIP bans an ip or cidr on every node of the host for d, or for ever if d is 0.
+func BanIP(cidr string, d time.Duration, reason, source string) error {
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("parse ban error: %s", err)
+	}
+	ban := Ban{CIDR: p.String(), Reason: reason, Source: source}
+	if d > 0 {
+		ban.Until = time.Now().Add(d).Unix()
+	}
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	bans.put(p, ban)
+	bans.save()
+	return nil
+}
+
+// UnbanIP lifts every ban of an ip or cidr, it reports whether there was one.
+func UnbanIP(cidr string) bool {
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	if !bans.removeAll(p) {
+		return false
+	}
+	bans.save()
+	return true
+}
+
+// Bans returns the bans in effect.
+func Bans() []Ban {
+	bans.mu.RLock()
+	defer bans.mu.RUnlock()
+	return bans.list()
+}
+
+// SetSourceBans replaces the bans added by source with list, this is how
+// bans pulled from a panel are kept in step with it. Bans of other sources
+// on the same prefix are left alone.
+func SetSourceBans(source string, list []Ban) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	changed := false
+	keep := make(map[netip.Prefix]bool, len(list))
+	for _, ban := range list {
+		p, err := parsePrefix(ban.CIDR)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"source": source,
+				"cidr":   ban.CIDR,
+				"err":    err,
+			}).Warn("Ignore invalid ban")
+			continue
+		}
+		ban.CIDR = p.String()
+		ban.Source = source
+		keep[p] = true
+		if old, ok := bans.bans[p][source]; !ok || old != ban {
+			bans.put(p, ban)
+			changed = true
+		}
+	}
+	for p, m := range bans.bans {
+		if _, ok := m[source]; ok && !keep[p] {
+			bans.remove(p, source)
+			changed = true
+		}
+	}
+	if changed {
+		bans.save()
+	}
+}
+
+// IsBanned reports whether ip is covered by a ban in effect.
+func IsBanned(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	bans.mu.RLock()
+	defer bans.mu.RUnlock()
+	if len(bans.bans) == 0 {
+		return false
+	}
+	now := time.Now().Unix()
+	for bits := range bans.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, _ := addr.Prefix(bits)
+		for _, ban := range bans.bans[p] {
+			if !ban.expired(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package limiter
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useBanList swaps the ban list of the host for an empty one kept in path.
+func useBanList(t *testing.T, path string) {
+	t.Helper()
+	old := bans
+	bans = &banList{
+		path: path,
+		bans: make(map[netip.Prefix]map[string]Ban),
+		bits: make(map[int]int),
+	}
+	t.Cleanup(func() {
+		bans.flush()
+		bans = old
+	})
+}
+
+func TestBanPrefix(t *testing.T) {
+	useBanList(t, "")
+	for _, cidr := range []string{"10.1.0.0/16", "2001:db8::/32", "::ffff:192.0.2.1", "::ffff:198.51.100.0/120"} {
+		if err := BanIP(cidr, 0, "", "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{ip: "10.1.2.3", banned: true},
+		{ip: "10.2.0.1"},
+		{ip: "::ffff:10.1.255.255", banned: true},
+		{ip: "2001:db8:ffff::1", banned: true},
+		{ip: "2001:db9::1"},
+		{ip: "192.0.2.1", banned: true},
+		{ip: "192.0.2.2"},
+		{ip: "198.51.100.77", banned: true},
+		{ip: "not an ip"},
+	}
+	for _, tt := range tests {
+		if got := IsBanned(tt.ip); got != tt.banned {
+			t.Fatalf("IsBanned(%s) = %v, want %v", tt.ip, got, tt.banned)
+		}
+	}
+	if !UnbanIP("10.1.0.0/16") || IsBanned("10.1.2.3") {
+		t.Fatal("unbanned prefix still banned")
+	}
+}
+
+// Every source keeps its own ban of a prefix, with its own expiry.
+func TestBanSourceExpiry(t *testing.T) {
+	useBanList(t, "")
+	p := netip.MustParsePrefix("10.0.0.0/8")
+	bans.put(p, Ban{CIDR: p.String(), Until: time.Now().Add(-time.Minute).Unix(), Source: "auth"})
+	if IsBanned("10.0.0.1") {
+		t.Fatal("expired ban in effect")
+	}
+	SetSourceBans("panel:1", []Ban{{CIDR: "10.0.0.0/8"}})
+	if err := BanIP("10.0.0.0/8", time.Hour, "", "auth"); err != nil {
+		t.Fatal(err)
+	}
+	if len(Bans()) != 2 {
+		t.Fatalf("bans = %+v, want one per source", Bans())
+	}
+	SetSourceBans("panel:1", nil)
+	if !IsBanned("10.0.0.1") {
+		t.Fatal("ban of one source lifted by another")
+	}
+	bans.mu.Lock()
+	bans.bans[p]["auth"] = Ban{CIDR: p.String(), Until: time.Now().Add(-time.Second).Unix(), Source: "auth"}
+	bans.mu.Unlock()
+	if IsBanned("10.0.0.1") {
+		t.Fatal("ban in effect after its only source expired")
+	}
+}
+
+// Bans are written to the file and read back after a restart, without the
+// expired ones.
+func TestBanSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	useBanList(t, "")
+	if err := LoadBans(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := BanIP("10.0.0.1", 0, "scan", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BanIP("2001:db8::/48", time.Hour, "", "auth"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BanIP("192.0.2.1", time.Hour, "", "auth"); err != nil {
+		t.Fatal(err)
+	}
+	bans.mu.Lock()
+	p := netip.MustParsePrefix("192.0.2.1/32")
+	bans.bans[p]["auth"] = Ban{CIDR: p.String(), Until: time.Now().Add(-time.Second).Unix(), Source: "auth"}
+	bans.mu.Unlock()
+	want := Bans()
+	SaveBans()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	useBanList(t, "")
+	if err := LoadBans(path); err != nil {
+		t.Fatal(err)
+	}
+	got := Bans()
+	if len(got) != 2 || len(got) != len(want) {
+		t.Fatalf("loaded bans = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("loaded bans = %+v, want %+v", got, want)
+		}
+	}
+	if !IsBanned("10.0.0.1") || !IsBanned("2001:db8::5") || IsBanned("192.0.2.1") {
+		t.Fatal("loaded bans do not match the saved ones")
+	}
+}
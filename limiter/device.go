@@ -0,0 +1,116 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// deviceTTL is how long an ip keeps its device slot after it was last seen.
+const deviceTTL = 3 * time.Minute
+
+// DeviceRefreshInterval is how often the ips of the open links have to be
+// handed to RefreshDevices to keep them from expiring.
+const DeviceRefreshInterval = deviceTTL / 3
+
+// deviceUser is a user of one panel, uids of different panels are unrelated.
+type deviceUser struct {
+	panel string
+	uid   int
+}
+
+// deviceRegistry tracks the source ips of each user across every node of the
+// process, so a device limit holds across the local tags right away instead
+// of only after the panel has seen the devices.
+type deviceRegistry struct {
+	mu    sync.Mutex
+	users map[deviceUser]map[string]time.Time // value: {Key: Ip, value: last seen}
+}
+
+var devices = &deviceRegistry{
+	users: make(map[deviceUser]map[string]time.Time),
+}
+
+// admit records ip for user unless it would take the user over limit devices
+// on this host. added reports whether ip was not known before.
+func (r *deviceRegistry) admit(user deviceUser, ip string, limit int) (ok, added bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	ips, exists := r.users[user]
+	if !exists {
+		ips = make(map[string]time.Time)
+		r.users[user] = ips
+	}
+	for k, seen := range ips {
+		if now.Sub(seen) > deviceTTL {
+			delete(ips, k)
+		}
+	}
+	if _, known := ips[ip]; known {
+		ips[ip] = now
+		return true, false
+	}
+	if limit > 0 && len(ips) >= limit {
+		return false, false
+	}
+	ips[ip] = now
+	return true, true
+}
+
+// release drops ip of user after it was admitted but the connection was refused.
+func (r *deviceRegistry) release(user deviceUser, ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ips, ok := r.users[user]; ok {
+		delete(ips, ip)
+		if len(ips) == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// touch marks the known ip of user as seen now, an ip with a link open for
+// longer than deviceTTL keeps its slot this way.
+func (r *deviceRegistry) touch(user deviceUser, ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ips, ok := r.users[user]; ok {
+		if _, known := ips[ip]; known {
+			ips[ip] = time.Now()
+		}
+	}
+}
+
+// prune drops the expired ips of every user.
+func (r *deviceRegistry) prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for user, ips := range r.users {
+		for ip, seen := range ips {
+			if now.Sub(seen) > deviceTTL {
+				delete(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// RefreshDevices marks the ips of the open links as seen, links is keyed
+// by TagUUID like the other maps of the limiter.
+func (l *Limiter) RefreshDevices(links map[string][]string) {
+	for taguuid, ips := range links {
+		v, ok := l.UserLimitInfo.Load(taguuid)
+		if !ok {
+			continue
+		}
+		user := deviceUser{panel: l.Panel, uid: v.(*UserLimitInfo).UID}
+		for _, ip := range ips {
+			if device, counted := deviceKey(ip); counted {
+				devices.touch(user, device)
+			}
+		}
+	}
+}
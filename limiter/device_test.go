@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/format"
+)
+
+// An ip holds its device slot for deviceTTL after it was last seen.
+func TestDeviceTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration // since the first ip was last seen
+		touched bool          // first ip refreshed by an open link
+		admit   bool          // second ip gets the only slot
+	}{
+		{name: "fresh", age: time.Minute, admit: false},
+		{name: "expired", age: deviceTTL + time.Second, admit: true},
+		{name: "expired but refreshed", age: deviceTTL + time.Second, touched: true, admit: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &deviceRegistry{users: make(map[deviceUser]map[string]time.Time)}
+			user := deviceUser{panel: "p", uid: 1}
+			if ok, added := r.admit(user, "10.0.0.1", 1); !ok || !added {
+				t.Fatal("first ip not admitted")
+			}
+			r.users[user]["10.0.0.1"] = time.Now().Add(-tt.age)
+			if tt.touched {
+				r.touch(user, "10.0.0.1")
+			}
+			if ok, _ := r.admit(user, "10.0.0.2", 1); ok != tt.admit {
+				t.Fatalf("second ip admitted = %v, want %v", ok, tt.admit)
+			}
+		})
+	}
+}
+
+func TestDevicePrune(t *testing.T) {
+	r := &deviceRegistry{users: make(map[deviceUser]map[string]time.Time)}
+	user := deviceUser{panel: "p", uid: 1}
+	r.admit(user, "10.0.0.1", 0)
+	r.admit(user, "10.0.0.2", 0)
+	r.users[user]["10.0.0.1"] = time.Now().Add(-deviceTTL - time.Second)
+	r.prune()
+	if _, ok := r.users[user]["10.0.0.1"]; ok {
+		t.Fatal("expired ip not pruned")
+	}
+	r.users[user]["10.0.0.2"] = time.Now().Add(-deviceTTL - time.Second)
+	r.prune()
+	if _, ok := r.users[user]; ok {
+		t.Fatal("user without ips not pruned")
+	}
+}
+
+// The device limit of a user holds across the nodes of one panel on the
+// host, users of another panel with the same uid are unrelated.
+func TestDeviceLimitAcrossNodes(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{{Id: 7, Uuid: "u7", DeviceLimit: 1}}
+	newLimiter := func(tag, api string) *Limiter {
+		l := AddLimiter(tag, users, map[int]int{})
+		l.Panel = api
+		t.Cleanup(func() { DeleteLimiter(tag) })
+		return l
+	}
+	a := newLimiter("a", "https://one.test")
+	b := newLimiter("b", "https://one.test")
+	c := newLimiter("c", "https://two.test")
+	t.Cleanup(func() {
+		devices.release(deviceUser{panel: "https://one.test", uid: 7}, "10.0.0.1")
+		devices.release(deviceUser{panel: "https://two.test", uid: 7}, "10.0.0.2")
+	})
+
+	tests := []struct {
+		name   string
+		l      *Limiter
+		ip     string
+		reject bool
+	}{
+		{name: "first device", l: a, ip: "10.0.0.1"},
+		{name: "second device on another node", l: b, ip: "10.0.0.2", reject: true},
+		{name: "first device on another node", l: b, ip: "10.0.0.1"},
+		{name: "same uid on another panel", l: c, ip: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		_, _, reject := tt.l.CheckLimit(format.UserTag(tt.l.Tag, "u7"), tt.ip, true, true)
+		if reject != tt.reject {
+			t.Fatalf("%s: reject = %v, want %v", tt.name, reject, tt.reject)
+		}
+	}
+}
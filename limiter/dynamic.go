@@ -1,5 +1,45 @@
 package limiter
 
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// dynamicLimit is a dynamic speed limit of a user, replaced as a whole so
+// links read it without a lock.
+type dynamicLimit struct {
+	limit int   // Mbps
+	until int64 // unix time
+}
+
+// dynamicWaiter waits on the bucket of a link under a dynamic speed limit.
+// Once the limit is over it takes the bucket the user has then, so a long
+// link doesn't stay throttled.
+type dynamicWaiter struct {
+	mu      sync.Mutex
+	bucket  *ratelimit.Bucket
+	until   int64
+	current func() (*ratelimit.Bucket, int64)
+}
+
+func newDynamicWaiter(b *ratelimit.Bucket, until int64, current func() (*ratelimit.Bucket, int64)) *dynamicWaiter {
+	return &dynamicWaiter{bucket: b, until: until, current: current}
+}
+
+func (w *dynamicWaiter) Wait(n int64) {
+	w.mu.Lock()
+	if w.until != 0 && time.Now().Unix() >= w.until {
+		w.bucket, w.until = w.current()
+	}
+	b := w.bucket
+	w.mu.Unlock()
+	if b != nil {
+		b.Wait(n)
+	}
+}
+
 // determineSpeedLimit returns the minimum non-zero rate
 func determineSpeedLimit(limit1, limit2 int) (limit int) {
 	if limit1 == 0 || limit2 == 0 {
@@ -2,14 +2,16 @@ package limiter
 
 import (
 	"errors"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/ratelimit"
 	panel "github.com/wyx2685/v2node/api/v2board"
 	"github.com/wyx2685/v2node/common/format"
+	"github.com/wyx2685/v2node/common/metrics"
+	"github.com/wyx2685/v2node/common/rate"
 )
 
 var limitLock sync.RWMutex
@@ -17,50 +19,79 @@ var limiter map[string]*Limiter
 
 func Init() {
 	limiter = map[string]*Limiter{}
+	metrics.RegisterCollector("limiter", collectLimiter)
+}
+
+// collectLimiter refreshes the online and throttled gauges of every limiter.
+func collectLimiter() {
+	metrics.OnlineUsers.Reset()
+	metrics.OnlineIPs.Reset()
+	metrics.ThrottledUsers.Reset()
+	limitLock.RLock()
+	defer limitLock.RUnlock()
+	for tag, l := range limiter {
+		users, ips := 0, 0
+		l.UserOnlineIP.Range(func(_, value interface{}) bool {
+			users++
+			value.(*sync.Map).Range(func(_, _ interface{}) bool {
+				ips++
+				return true
+			})
+			return true
+		})
+		metrics.OnlineUsers.Set(float64(users), tag)
+		metrics.OnlineIPs.Set(float64(ips), tag)
+		metrics.ThrottledUsers.Set(float64(len(l.Throttled())), tag)
+	}
 }
 
 type Limiter struct {
-	DomainRules   []*regexp.Regexp
-	ProtocolRules []string
-	SpeedLimit    int
-	UserOnlineIP  *sync.Map      // Key: TagUUID, value: {Key: Ip, value: Uid}
-	OldUserOnline *sync.Map      // Key: Ip, value: Uid
-	UUIDtoUID     map[string]int // Key: UUID, value: Uid
-	UserLimitInfo *sync.Map      // Key: TagUUID value: UserLimitInfo
-	SpeedLimiter  *sync.Map      // key: TagUUID, value: *ratelimit.Bucket
-	AliveList     map[int]int    // Key: Uid, value: alive_ip
+	Tag            string
+	Panel          string // api host, uids are only unique within a panel
+	DomainRules    []DomainRule
+	ProtocolRules  []ProtocolRule
+	SpeedLimitUp   int            // node cap per user in Mbps
+	SpeedLimitDown int            // node cap per user in Mbps
+	ConnLimit      int            // default concurrent links per user and network
+	UserOnlineIP   *sync.Map      // Key: TagUUID, value: {Key: Ip, value: Uid}
+	OldUserOnline  *sync.Map      // Key: Ip, value: Uid
+	UUIDtoUID      map[string]int // Key: UUID, value: Uid
+	UserLimitInfo  *sync.Map      // Key: TagUUID value: UserLimitInfo
+	SpeedLimiter   *sync.Map      // key: TagUUID, value: *Buckets
+	AliveList      map[int]int    // Key: Uid, value: alive_ip
+	nodeUp         *shaper
+	nodeDown       *shaper
+	unreported     func() map[int]int64 // guarded by limitLock
+	auditLock      sync.RWMutex
+	eventLock      sync.Mutex
+	auditEvents    []panel.AuditEvent
 }
 
 type UserLimitInfo struct {
-	UID               int
-	SpeedLimit        int
-	DeviceLimit       int
-	DynamicSpeedLimit int
-	ExpireTime        int64
-	OverLimit         bool
+	UID            int
+	SpeedLimitUp   int
+	SpeedLimitDown int
+	DeviceLimit    int
+	ConnLimit      int
+	OverLimit      bool
+	dynamic        atomic.Pointer[dynamicLimit] // set by the dynamic limit task, read by links
 }
 
 func AddLimiter(tag string, users []panel.UserInfo, aliveList map[int]int) *Limiter {
 	info := &Limiter{
+		Tag:           tag,
 		UserOnlineIP:  new(sync.Map),
 		UserLimitInfo: new(sync.Map),
 		SpeedLimiter:  new(sync.Map),
 		AliveList:     aliveList,
 		OldUserOnline: new(sync.Map),
+		nodeUp:        newShaper(),
+		nodeDown:      newShaper(),
 	}
 	uuidmap := make(map[string]int)
 	for i := range users {
 		uuidmap[users[i].Uuid] = users[i].Id
-		userLimit := &UserLimitInfo{}
-		userLimit.UID = users[i].Id
-		if users[i].SpeedLimit != 0 {
-			userLimit.SpeedLimit = users[i].SpeedLimit
-		}
-		if users[i].DeviceLimit != 0 {
-			userLimit.DeviceLimit = users[i].DeviceLimit
-		}
-		userLimit.OverLimit = false
-		info.UserLimitInfo.Store(format.UserTag(tag, users[i].Uuid), userLimit)
+		info.UserLimitInfo.Store(format.UserTag(tag, users[i].Uuid), newUserLimitInfo(&users[i]))
 	}
 	info.UUIDtoUID = uuidmap
 	limitLock.Lock()
@@ -81,8 +112,12 @@ func GetLimiter(tag string) (info *Limiter, err error) {
 
 func DeleteLimiter(tag string) {
 	limitLock.Lock()
+	l, ok := limiter[tag]
 	delete(limiter, tag)
 	limitLock.Unlock()
+	if ok {
+		quotas.dropTag(l.Panel, tag)
+	}
 }
 
 func (l *Limiter) UpdateUser(tag string, added []panel.UserInfo, deleted []panel.UserInfo) {
@@ -90,65 +125,159 @@ func (l *Limiter) UpdateUser(tag string, added []panel.UserInfo, deleted []panel
 		l.UserLimitInfo.Delete(format.UserTag(tag, deleted[i].Uuid))
 		l.UserOnlineIP.Delete(format.UserTag(tag, deleted[i].Uuid))
 		l.SpeedLimiter.Delete(format.UserTag(tag, deleted[i].Uuid))
+		quotas.drop(deviceUser{panel: l.Panel, uid: deleted[i].Id}, tag)
 		delete(l.UUIDtoUID, deleted[i].Uuid)
 		delete(l.AliveList, deleted[i].Id)
 	}
 	for i := range added {
-		userLimit := &UserLimitInfo{
-			UID: added[i].Id,
-		}
-		if added[i].SpeedLimit != 0 {
-			userLimit.SpeedLimit = added[i].SpeedLimit
-			userLimit.ExpireTime = 0
-		}
-		if added[i].DeviceLimit != 0 {
-			userLimit.DeviceLimit = added[i].DeviceLimit
-		}
-		userLimit.OverLimit = false
-		l.UserLimitInfo.Store(format.UserTag(tag, added[i].Uuid), userLimit)
+		l.UserLimitInfo.Store(format.UserTag(tag, added[i].Uuid), newUserLimitInfo(&added[i]))
 		l.UUIDtoUID[added[i].Uuid] = added[i].Id
 	}
 }
 
+// newUserLimitInfo takes the per direction speed limits of u,
+// falling back to its single speed limit.
+func newUserLimitInfo(u *panel.UserInfo) *UserLimitInfo {
+	info := &UserLimitInfo{
+		UID:            u.Id,
+		SpeedLimitUp:   u.SpeedLimit,
+		SpeedLimitDown: u.SpeedLimit,
+		DeviceLimit:    u.DeviceLimit,
+		ConnLimit:      u.ConnLimit,
+	}
+	if u.SpeedLimitUp != 0 {
+		info.SpeedLimitUp = u.SpeedLimitUp
+	}
+	if u.SpeedLimitDown != 0 {
+		info.SpeedLimitDown = u.SpeedLimitDown
+	}
+	return info
+}
+
 func (l *Limiter) UpdateDynamicSpeedLimit(tag, uuid string, limit int, expire time.Time) error {
 	if v, ok := l.UserLimitInfo.Load(format.UserTag(tag, uuid)); ok {
 		info := v.(*UserLimitInfo)
-		info.DynamicSpeedLimit = limit
-		info.ExpireTime = expire.Unix()
+		info.dynamic.Store(&dynamicLimit{limit: limit, until: expire.Unix()})
+		// new links get buckets with the dynamic limit
+		l.SpeedLimiter.Delete(format.UserTag(tag, uuid))
 	} else {
 		return errors.New("not found")
 	}
 	return nil
 }
 
-func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool) (Bucket *ratelimit.Bucket, Reject bool) {
+type ThrottledUser struct {
+	UID   int       `json:"uid"`
+	Limit int       `json:"limit"`
+	Until time.Time `json:"until"`
+}
+
+// Throttled returns the users under a dynamic speed limit.
+func (l *Limiter) Throttled() []ThrottledUser {
+	var users []ThrottledUser
+	now := time.Now().Unix()
+	l.UserLimitInfo.Range(func(_, value interface{}) bool {
+		u := value.(*UserLimitInfo)
+		if d := u.dynamic.Load(); d != nil && d.limit > 0 && d.until > now {
+			users = append(users, ThrottledUser{
+				UID:   u.UID,
+				Limit: d.limit,
+				Until: time.Unix(d.until, 0),
+			})
+		}
+		return true
+	})
+	return users
+}
+
+// SetNodeSpeedLimit caps the total rate of the node in each direction,
+// shared fairly between its users. 0 removes the cap.
+func (l *Limiter) SetNodeSpeedLimit(mbps int) {
+	l.nodeUp.setLimit(mbps)
+	l.nodeDown.setLimit(mbps)
+}
+
+// UserConnLimit returns how many links of each network the user may have open, 0 is unlimited.
+func (l *Limiter) UserConnLimit(taguuid string) int {
+	if v, ok := l.UserLimitInfo.Load(taguuid); ok {
+		if limit := v.(*UserLimitInfo).ConnLimit; limit > 0 {
+			return limit
+		}
+	}
+	return l.ConnLimit
+}
+
+// UserUID returns the panel id of the user, 0 if it is unknown.
+func (l *Limiter) UserUID(taguuid string) int {
+	if v, ok := l.UserLimitInfo.Load(taguuid); ok {
+		return v.(*UserLimitInfo).UID
+	}
+	return 0
+}
+
+// Buckets are the speed limit buckets of a user, nil for an unlimited direction.
+type Buckets struct {
+	Up   *ratelimit.Bucket
+	Down *ratelimit.Bucket
+}
+
+// newBucket returns a bucket for mbps, or nil if it is not limited.
+func newBucket(mbps int) *ratelimit.Bucket {
+	if mbps <= 0 {
+		return nil
+	}
+	limit := int64(mbps) * 1000000 / 8 // Byte/s
+	return ratelimit.NewBucketWithQuantum(time.Second, limit, limit)
+}
+
+// withWaiter adds the user waiter u in front of the node waiter w.
+func withWaiter(u rate.Waiter, w rate.Waiter) rate.Waiter {
+	switch {
+	case u == nil:
+		return w
+	case w == nil:
+		return u
+	default:
+		return rate.Chain{u, w}
+	}
+}
+
+func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool) (Up, Down rate.Waiter, Reject bool) {
 	// check if ipv4 mapped ipv6
 	ip = strings.TrimPrefix(ip, "::ffff:")
 
-	// check and gen speed limit Bucket
-	nodeLimit := l.SpeedLimit
-	userLimit := 0
 	deviceLimit := 0
 	var uid int
+	var u *UserLimitInfo
 	if v, ok := l.UserLimitInfo.Load(taguuid); ok {
-		u := v.(*UserLimitInfo)
+		u = v.(*UserLimitInfo)
 		deviceLimit = u.DeviceLimit
 		uid = u.UID
-		if u.ExpireTime < time.Now().Unix() && u.ExpireTime != 0 {
-			if u.SpeedLimit != 0 {
-				userLimit = u.SpeedLimit
-				u.DynamicSpeedLimit = 0
-				u.ExpireTime = 0
-			} else {
-				l.UserLimitInfo.Delete(taguuid)
-			}
-		} else {
-			userLimit = determineSpeedLimit(u.SpeedLimit, u.DynamicSpeedLimit)
-		}
 	} else {
-		return nil, true
+		return nil, nil, true
 	}
+	if q := l.Quota(taguuid); q != nil && q.Exhausted() {
+		return nil, nil, true
+	}
+	device, counted := deviceKey(ip)
 	if noSSUDP {
+		// count ips of one prefix as the same device, an allowlisted ip is
+		// still reported online but never takes a device slot
+		if counted {
+			ip = device
+		}
+		limited := counted && deviceLimit > 0
+		// Check the devices of the user on every node of this host
+		user := deviceUser{panel: l.Panel, uid: uid}
+		added := false
+		if counted {
+			var admitted bool
+			admitted, added = devices.admit(user, ip, deviceLimit)
+			if !admitted {
+				metrics.DeviceLimitRejects.Inc(l.Tag)
+				return nil, nil, true
+			}
+		}
 		// Store online user for device limit
 		newipMap := new(sync.Map)
 		newipMap.Store(ip, uid)
@@ -162,10 +291,14 @@ func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool
 					if v.(int) == uid {
 						l.OldUserOnline.Delete(ip)
 					}
-				} else if deviceLimit > 0 {
+				} else if limited {
 					if deviceLimit <= aliveIp {
 						oldipMap.Delete(ip)
-						return nil, true
+						if added {
+							devices.release(user, ip)
+						}
+						metrics.DeviceLimitRejects.Inc(l.Tag)
+						return nil, nil, true
 					}
 				}
 			}
@@ -174,30 +307,78 @@ func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool
 				l.OldUserOnline.Delete(ip)
 			}
 		} else {
-			if deviceLimit > 0 {
+			if limited {
 				if deviceLimit <= aliveIp {
 					l.UserOnlineIP.Delete(taguuid)
-					return nil, true
+					if added {
+						devices.release(user, ip)
+					}
+					metrics.DeviceLimitRejects.Inc(l.Tag)
+					return nil, nil, true
 				}
 			}
 		}
 	}
 
-	limit := int64(determineSpeedLimit(nodeLimit, userLimit)) * 1000000 / 8 // If you need the Speed limit
-	if limit > 0 {
-		Bucket = ratelimit.NewBucketWithQuantum(time.Second, limit, limit) // Byte/s
-		if v, ok := l.SpeedLimiter.LoadOrStore(taguuid, Bucket); ok {
-			return v.(*ratelimit.Bucket), false
-		} else {
-			l.SpeedLimiter.Store(taguuid, Bucket)
-			return Bucket, false
+	// check and gen speed limit Bucket
+	b, until := l.currentBuckets(taguuid, u)
+	up, down := rate.Waiter(nil), rate.Waiter(nil)
+	if b.Up != nil {
+		up = b.Up
+	}
+	if b.Down != nil {
+		down = b.Down
+	}
+	if until != 0 {
+		// links outlive the dynamic limit, they go back to the usual buckets after it
+		up = newDynamicWaiter(b.Up, until, func() (*ratelimit.Bucket, int64) {
+			b, until := l.currentBuckets(taguuid, u)
+			return b.Up, until
+		})
+		down = newDynamicWaiter(b.Down, until, func() (*ratelimit.Bucket, int64) {
+			b, until := l.currentBuckets(taguuid, u)
+			return b.Down, until
+		})
+	}
+	return withWaiter(up, l.nodeUp.waiter(taguuid)), withWaiter(down, l.nodeDown.waiter(taguuid)), false
+}
+
+// currentBuckets returns the buckets of the user u under its current limits,
+// with the end of its dynamic limit or 0 if it has none.
+func (l *Limiter) currentBuckets(taguuid string, u *UserLimitInfo) (*Buckets, int64) {
+	dynamic, until := 0, int64(0)
+	if d := u.dynamic.Load(); d != nil {
+		if d.until > time.Now().Unix() {
+			dynamic, until = d.limit, d.until
+		} else if u.dynamic.CompareAndSwap(d, nil) {
+			// the dynamic limit is over, rebuild the buckets without it
+			l.SpeedLimiter.Delete(taguuid)
 		}
-	} else {
-		return nil, false
 	}
+	upLimit := determineSpeedLimit(l.SpeedLimitUp, determineSpeedLimit(u.SpeedLimitUp, dynamic))
+	downLimit := determineSpeedLimit(l.SpeedLimitDown, determineSpeedLimit(u.SpeedLimitDown, dynamic))
+	if upLimit == 0 && downLimit == 0 {
+		return &Buckets{}, until
+	}
+	return l.userBuckets(taguuid, upLimit, downLimit), until
+}
+
+func (l *Limiter) userBuckets(taguuid string, upLimit, downLimit int) *Buckets {
+	if v, ok := l.SpeedLimiter.Load(taguuid); ok {
+		return v.(*Buckets)
+	}
+	b := &Buckets{
+		Up:   newBucket(upLimit),
+		Down: newBucket(downLimit),
+	}
+	if v, loaded := l.SpeedLimiter.LoadOrStore(taguuid, b); loaded {
+		b = v.(*Buckets)
+	}
+	return b
 }
 
 func (l *Limiter) GetOnlineDevice() (*[]panel.OnlineUser, error) {
+	devices.prune()
 	var onlineUser []panel.OnlineUser
 	l.OldUserOnline = new(sync.Map)
 	l.UserOnlineIP.Range(func(key, value interface{}) bool {
@@ -217,6 +398,20 @@ func (l *Limiter) GetOnlineDevice() (*[]panel.OnlineUser, error) {
 	return &onlineUser, nil
 }
 
+// OnlineDevices returns the devices seen since the last report without
+// resetting them, unlike GetOnlineDevice.
+func (l *Limiter) OnlineDevices() []panel.OnlineUser {
+	var onlineUser []panel.OnlineUser
+	l.UserOnlineIP.Range(func(_, value interface{}) bool {
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			onlineUser = append(onlineUser, panel.OnlineUser{UID: value.(int), IP: key.(string)})
+			return true
+		})
+		return true
+	})
+	return onlineUser
+}
+
 type UserIpList struct {
 	Uid    int      `json:"Uid"`
 	IpList []string `json:"Ips"`
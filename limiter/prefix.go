@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/wyx2685/v2node/conf"
+)
+
+type deviceOptions struct {
+	ipv4Bits  int
+	ipv6Bits  int
+	allowlist []netip.Prefix
+}
+
+var deviceOpts atomic.Pointer[deviceOptions]
+
+// SetDeviceConfig sets how source ips are grouped into devices.
+func SetDeviceConfig(c *conf.DeviceConfig) error {
+	o := &deviceOptions{ipv4Bits: 32, ipv6Bits: 128}
+	if c.IPv4Prefix != 0 {
+		if c.IPv4Prefix < 8 || c.IPv4Prefix > 32 {
+			return fmt.Errorf("invalid ipv4 device prefix: %d", c.IPv4Prefix)
+		}
+		o.ipv4Bits = c.IPv4Prefix
+	}
+	if c.IPv6Prefix != 0 {
+		if c.IPv6Prefix < 16 || c.IPv6Prefix > 128 {
+			return fmt.Errorf("invalid ipv6 device prefix: %d", c.IPv6Prefix)
+		}
+		o.ipv6Bits = c.IPv6Prefix
+	}
+	for _, s := range c.Allowlist {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return fmt.Errorf("parse device allowlist error: %s", err)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		o.allowlist = append(o.allowlist, p.Masked())
+	}
+	deviceOpts.Store(o)
+	return nil
+}
+
+// deviceKey returns the device an ip counts as, which is the network address
+// of its prefix when ips are grouped. An ipv4-mapped ipv6 address counts as
+// its ipv4 address. counted is false for allowlisted ips.
+func deviceKey(ip string) (key string, counted bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip, true
+	}
+	addr = addr.Unmap()
+	o := deviceOpts.Load()
+	if o == nil {
+		return addr.String(), true
+	}
+	for _, p := range o.allowlist {
+		if p.Contains(addr) {
+			return "", false
+		}
+	}
+	bits := o.ipv6Bits
+	if addr.Is4() {
+		bits = o.ipv4Bits
+	}
+	if bits >= addr.BitLen() {
+		return addr.String(), true
+	}
+	p, _ := addr.Prefix(bits)
+	return p.Addr().String(), true
+}
@@ -0,0 +1,135 @@
+package limiter
+
+import (
+	"testing"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/format"
+	"github.com/wyx2685/v2node/conf"
+)
+
+func TestDeviceKey(t *testing.T) {
+	t.Cleanup(func() { deviceOpts.Store(nil) })
+	tests := []struct {
+		name    string
+		config  *conf.DeviceConfig // nil leaves ips ungrouped
+		ip      string
+		key     string
+		counted bool
+	}{
+		{name: "ungrouped ipv4", ip: "10.1.2.3", key: "10.1.2.3", counted: true},
+		{name: "ungrouped mapped", ip: "::ffff:10.1.2.3", key: "10.1.2.3", counted: true},
+		{name: "not an ip", ip: "unknown", key: "unknown", counted: true},
+		{
+			name:    "full ipv4 prefix",
+			config:  &conf.DeviceConfig{IPv6Prefix: 64},
+			ip:      "10.1.2.3",
+			key:     "10.1.2.3",
+			counted: true,
+		},
+		{
+			name:    "full ipv4 prefix mapped",
+			config:  &conf.DeviceConfig{IPv6Prefix: 64},
+			ip:      "::ffff:10.1.2.3",
+			key:     "10.1.2.3",
+			counted: true,
+		},
+		{
+			name:    "ipv4 prefix",
+			config:  &conf.DeviceConfig{IPv4Prefix: 24},
+			ip:      "10.1.2.3",
+			key:     "10.1.2.0",
+			counted: true,
+		},
+		{
+			name:    "mapped into the ipv4 prefix",
+			config:  &conf.DeviceConfig{IPv4Prefix: 24, IPv6Prefix: 64},
+			ip:      "::ffff:10.1.2.200",
+			key:     "10.1.2.0",
+			counted: true,
+		},
+		{
+			name:    "ipv6 prefix",
+			config:  &conf.DeviceConfig{IPv6Prefix: 64},
+			ip:      "2001:db8:1:2:aaaa::1",
+			key:     "2001:db8:1:2::",
+			counted: true,
+		},
+		{
+			name:    "full ipv6 prefix",
+			config:  &conf.DeviceConfig{IPv4Prefix: 24},
+			ip:      "2001:db8:1:2:aaaa::1",
+			key:     "2001:db8:1:2:aaaa::1",
+			counted: true,
+		},
+		{
+			name:   "allowlisted prefix",
+			config: &conf.DeviceConfig{IPv4Prefix: 24, Allowlist: []string{"192.168.0.0/16"}},
+			ip:     "192.168.5.6",
+		},
+		{
+			name:   "allowlisted mapped",
+			config: &conf.DeviceConfig{Allowlist: []string{"192.168.5.6"}},
+			ip:     "::ffff:192.168.5.6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceOpts.Store(nil)
+			if tt.config != nil {
+				if err := SetDeviceConfig(tt.config); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key, counted := deviceKey(tt.ip)
+			if key != tt.key || counted != tt.counted {
+				t.Fatalf("deviceKey(%s) = %q, %v, want %q, %v", tt.ip, key, counted, tt.key, tt.counted)
+			}
+		})
+	}
+}
+
+func TestSetDeviceConfigInvalid(t *testing.T) {
+	t.Cleanup(func() { deviceOpts.Store(nil) })
+	for _, c := range []*conf.DeviceConfig{
+		{IPv4Prefix: 7},
+		{IPv4Prefix: 33},
+		{IPv6Prefix: 15},
+		{IPv6Prefix: 129},
+		{Allowlist: []string{"10.0.0.0/33"}},
+	} {
+		if err := SetDeviceConfig(c); err == nil {
+			t.Fatalf("config %+v accepted", c)
+		}
+	}
+}
+
+// Ips of one prefix take a single device slot, an allowlisted ip takes none.
+func TestDevicePrefixLimit(t *testing.T) {
+	Init()
+	t.Cleanup(func() { deviceOpts.Store(nil) })
+	if err := SetDeviceConfig(&conf.DeviceConfig{IPv4Prefix: 24, Allowlist: []string{"192.168.0.0/16"}}); err != nil {
+		t.Fatal(err)
+	}
+	l := AddLimiter("prefix", []panel.UserInfo{{Id: 8, Uuid: "u8", DeviceLimit: 1}}, map[int]int{})
+	l.Panel = "https://prefix.test"
+	t.Cleanup(func() {
+		DeleteLimiter("prefix")
+		devices.release(deviceUser{panel: "https://prefix.test", uid: 8}, "10.0.0.0")
+	})
+	tests := []struct {
+		ip     string
+		reject bool
+	}{
+		{ip: "10.0.0.1"},
+		{ip: "::ffff:10.0.0.2"},
+		{ip: "192.168.1.1"},
+		{ip: "10.0.1.1", reject: true},
+	}
+	for _, tt := range tests {
+		_, _, reject := l.CheckLimit(format.UserTag("prefix", "u8"), tt.ip, true, true)
+		if reject != tt.reject {
+			t.Fatalf("%s: reject = %v, want %v", tt.ip, reject, tt.reject)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package limiter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+)
+
+// Quota is the traffic a user may still use on this host, in bytes.
+type Quota struct {
+	remaining atomic.Int64
+}
+
+// Consume takes n bytes from the quota and reports whether any is left.
+func (q *Quota) Consume(n int64) bool {
+	return q.remaining.Add(-n) > 0
+}
+
+func (q *Quota) Exhausted() bool {
+	return q.remaining.Load() <= 0
+}
+
+// quotaRegistry holds one quota per user of a panel, keyed like the devices,
+// so a user on several local nodes of the panel spends a single quota.
+type quotaRegistry struct {
+	mu    sync.Mutex
+	users map[deviceUser]*quotaEntry
+}
+
+type quotaEntry struct {
+	quota *Quota
+	tags  map[string]struct{} // nodes that set the quota
+}
+
+var quotas = &quotaRegistry{
+	users: make(map[deviceUser]*quotaEntry),
+}
+
+func (r *quotaRegistry) get(user deviceUser) *Quota {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.users[user]; ok {
+		return e.quota
+	}
+	return nil
+}
+
+func (r *quotaRegistry) set(user deviceUser, tag string, remaining int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.users[user]
+	if !ok {
+		e = &quotaEntry{quota: &Quota{}, tags: make(map[string]struct{})}
+		r.users[user] = e
+	}
+	e.tags[tag] = struct{}{}
+	e.quota.remaining.Store(remaining)
+}
+
+// drop removes tag from the nodes of user, the quota goes with the last one.
+func (r *quotaRegistry) drop(user deviceUser, tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.users[user]; ok {
+		delete(e.tags, tag)
+		if len(e.tags) == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// dropTag removes tag from every user of panel.
+func (r *quotaRegistry) dropTag(panel string, tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for user, e := range r.users {
+		if user.panel != panel {
+			continue
+		}
+		delete(e.tags, tag)
+		if len(e.tags) == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// SetUnreported sets the function returning the traffic of the node that
+// the panel has not counted yet, by uid.
+func (l *Limiter) SetUnreported(unreported func() map[int]int64) {
+	limitLock.Lock()
+	l.unreported = unreported
+	limitLock.Unlock()
+}
+
+// unreportedOnHost adds up the unreported traffic of every node of panel.
+func unreportedOnHost(panel string) map[int]int64 {
+	var funcs []func() map[int]int64
+	limitLock.RLock()
+	for _, l := range limiter {
+		if l.Panel == panel && l.unreported != nil {
+			funcs = append(funcs, l.unreported)
+		}
+	}
+	limitLock.RUnlock()
+	total := make(map[int]int64)
+	for _, f := range funcs {
+		for uid, n := range f() {
+			total[uid] += n
+		}
+	}
+	return total
+}
+
+// UpdateQuota sets the quota of users from the remaining traffic the panel
+// sent, less the traffic of every node of the panel on this host that the
+// panel has not counted yet. Users without a remaining value are not limited.
+func (l *Limiter) UpdateQuota(tag string, users []panel.UserInfo) {
+	var unreported map[int]int64
+	for i := range users {
+		user := deviceUser{panel: l.Panel, uid: users[i].Id}
+		if users[i].Remaining == nil {
+			quotas.drop(user, tag)
+			continue
+		}
+		if unreported == nil {
+			unreported = unreportedOnHost(l.Panel)
+		}
+		quotas.set(user, tag, *users[i].Remaining-unreported[users[i].Id])
+	}
+}
+
+// Quota returns the quota of the user, or nil if it is not limited.
+func (l *Limiter) Quota(taguuid string) *Quota {
+	v, ok := l.UserLimitInfo.Load(taguuid)
+	if !ok {
+		return nil
+	}
+	return quotas.get(deviceUser{panel: l.Panel, uid: v.(*UserLimitInfo).UID})
+}
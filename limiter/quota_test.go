@@ -0,0 +1,77 @@
+package limiter
+
+import (
+	"testing"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/format"
+)
+
+func addQuotaLimiter(t *testing.T, tag string, users []panel.UserInfo) *Limiter {
+	t.Helper()
+	l := AddLimiter(tag, users, nil)
+	l.Panel = "https://panel.test"
+	t.Cleanup(func() { DeleteLimiter(tag) })
+	return l
+}
+
+// A user on two nodes of one panel spends a single quota, less what the
+// nodes used that the panel has not counted, and is cut off on both.
+func TestQuotaCutoffAcrossNodes(t *testing.T) {
+	Init()
+	remaining := int64(100)
+	users := []panel.UserInfo{{Id: 1, Uuid: "u1", Remaining: &remaining}}
+	a := addQuotaLimiter(t, "a", users)
+	b := addQuotaLimiter(t, "b", users)
+	a.SetUnreported(func() map[int]int64 { return map[int]int64{1: 20} })
+	b.SetUnreported(func() map[int]int64 { return map[int]int64{1: 10} })
+	a.UpdateQuota("a", users)
+	b.UpdateQuota("b", users)
+
+	qa, qb := a.Quota(format.UserTag("a", "u1")), b.Quota(format.UserTag("b", "u1"))
+	if qa == nil || qa != qb {
+		t.Fatal("nodes of one panel do not share the quota")
+	}
+	if got := qa.remaining.Load(); got != 70 {
+		t.Fatalf("remaining = %d, want 70", got)
+	}
+	if !qa.Consume(50) {
+		t.Fatal("quota exhausted before the limit")
+	}
+	if qb.Consume(20) {
+		t.Fatal("quota left after the limit was used on the other node")
+	}
+	if _, _, reject := a.CheckLimit(format.UserTag("a", "u1"), "10.0.0.1", true, true); !reject {
+		t.Fatal("new link of a user without quota accepted")
+	}
+	if _, _, reject := b.CheckLimit(format.UserTag("b", "u1"), "10.0.0.1", true, true); !reject {
+		t.Fatal("new link of a user without quota accepted on the other node")
+	}
+}
+
+// A quota stays while any node of the user holds it.
+func TestQuotaDropped(t *testing.T) {
+	Init()
+	remaining := int64(100)
+	users := []panel.UserInfo{{Id: 2, Uuid: "u2", Remaining: &remaining}}
+	a := addQuotaLimiter(t, "a", users)
+	b := addQuotaLimiter(t, "b", users)
+	a.UpdateQuota("a", users)
+	b.UpdateQuota("b", users)
+
+	a.UpdateUser("a", nil, users)
+	if b.Quota(format.UserTag("b", "u2")) == nil {
+		t.Fatal("quota dropped while the user is on another node")
+	}
+	DeleteLimiter("b")
+	if quotas.get(deviceUser{panel: "https://panel.test", uid: 2}) != nil {
+		t.Fatal("quota kept after the user left every node")
+	}
+
+	unlimited := []panel.UserInfo{{Id: 3, Uuid: "u3"}}
+	c := addQuotaLimiter(t, "c", unlimited)
+	c.UpdateQuota("c", unlimited)
+	if c.Quota(format.UserTag("c", "u3")) != nil {
+		t.Fatal("user without remaining traffic has a quota")
+	}
+}
@@ -0,0 +1,193 @@
+package limiter
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wyx2685/v2node/common/rate"
+)
+
+const (
+	shareInterval = 500 * time.Millisecond
+	shareIdleMax  = 120 // rebalances without traffic before a share is dropped
+)
+
+// shaper caps the total rate of a node in one direction and splits it
+// between the active users by water-filling: users needing less than an
+// equal share keep what they use, the rest is divided among the others.
+// Every share also takes from one node bucket, so a share that is new or
+// back from idle can't push the total over the cap before the next rebalance.
+// Writes only take the lock to find their share, the buckets are atomic.
+type shaper struct {
+	mu     sync.RWMutex // guards shares, rebalance holds it for writing
+	rate   atomicFloat  // Byte/s, 0 is unlimited
+	shares map[string]*share
+	last   atomic.Int64 // unix nanos of the last rebalance
+	node   bucket
+}
+
+type share struct {
+	bucket
+	rate atomicFloat
+	used atomic.Int64 // bytes asked for since the last rebalance
+	idle int          // rebalances without traffic, only used by rebalance
+}
+
+// atomicFloat is a float64 that can be read and set from any goroutine.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) Store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+// bucket is a token bucket kept as the time at which everything taken from
+// it is paid off, so takes need no lock. Up to one shareInterval worth of
+// bytes is taken without waiting.
+type bucket struct {
+	paid atomic.Int64 // unix nanos
+}
+
+// take takes n bytes at rate and returns how long the caller has to sleep
+// to pay off the debt it ran into.
+func (b *bucket) take(n int64, rate float64, now int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	cost := int64(float64(n) / rate * float64(time.Second))
+	for {
+		old := b.paid.Load()
+		paid := max(old, now) + cost
+		if b.paid.CompareAndSwap(old, paid) {
+			return time.Duration(max(paid-now-int64(shareInterval), 0))
+		}
+	}
+}
+
+func newShaper() *shaper {
+	s := &shaper{
+		shares: make(map[string]*share),
+	}
+	s.last.Store(time.Now().UnixNano())
+	return s
+}
+
+func (s *shaper) setLimit(mbps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := float64(mbps) * 1000000 / 8
+	s.rate.Store(r)
+	if len(s.shares) == 0 {
+		return
+	}
+	for _, sh := range s.shares {
+		sh.rate.Store(r / float64(len(s.shares)))
+	}
+}
+
+// waiter returns the Waiter for the share of key, or nil if the node is not limited.
+func (s *shaper) waiter(key string) rate.Waiter {
+	if s.rate.Load() <= 0 {
+		return nil
+	}
+	return &shareWaiter{shaper: s, key: key}
+}
+
+type shareWaiter struct {
+	shaper *shaper
+	key    string
+}
+
+func (w *shareWaiter) Wait(n int64) {
+	w.shaper.wait(w.key, n)
+}
+
+// wait takes n bytes from the share of key and from the node bucket, going
+// into debt if needed, and sleeps until both debts are paid off.
+func (s *shaper) wait(key string, n int64) {
+	r := s.rate.Load()
+	if r <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	if last := s.last.Load(); now-last >= int64(shareInterval) && s.last.CompareAndSwap(last, now) {
+		s.rebalance(time.Duration(now - last).Seconds())
+	}
+	sh := s.share(key, now)
+	sh.used.Add(n)
+	time.Sleep(max(sh.take(n, sh.rate.Load(), now), s.node.take(n, r, now)))
+}
+
+// share returns the share of key, adding it with an equal part of the rate
+// and no burst if it is new.
+func (s *shaper) share(key string, now int64) *share {
+	s.mu.RLock()
+	sh, ok := s.shares[key]
+	s.mu.RUnlock()
+	if ok {
+		return sh
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sh, ok := s.shares[key]; ok {
+		return sh
+	}
+	sh = &share{}
+	sh.rate.Store(s.rate.Load() / float64(len(s.shares)+1))
+	sh.paid.Store(now + int64(shareInterval))
+	s.shares[key] = sh
+	return sh
+}
+
+// rebalance recomputes the rate of every share from what it used in the
+// elapsed seconds since the last call.
+func (s *shaper) rebalance(elapsed float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type demand struct {
+		share *share
+		want  float64
+	}
+	var active []demand
+	for key, sh := range s.shares {
+		used := sh.used.Swap(0)
+		if used == 0 {
+			if sh.idle++; sh.idle > shareIdleMax {
+				delete(s.shares, key)
+			}
+			continue
+		}
+		// ask for twice the current use, so a share can grow up to its fair part
+		active = append(active, demand{share: sh, want: 2 * float64(used) / elapsed})
+		sh.idle = 0
+	}
+	if len(active) == 0 {
+		return
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].want < active[j].want })
+	total := s.rate.Load()
+	remaining := total
+	rates := make([]float64, len(active))
+	for i, d := range active {
+		rates[i] = min(d.want, remaining/float64(len(active)-i))
+		remaining -= rates[i]
+	}
+	// hand out what nobody needed, so light users can still burst
+	for i, d := range active {
+		d.share.rate.Store(rates[i] + remaining/float64(len(active)))
+	}
+	// an idle user coming back starts with an equal share
+	for _, sh := range s.shares {
+		if sh.idle > 0 {
+			sh.rate.Store(total / float64(len(active)+1))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// The node rate goes to the light users first, the rest is split equally
+// between the heavy ones, and what nobody needs is handed out to all.
+func TestShaperWaterFilling(t *testing.T) {
+	tests := []struct {
+		name string
+		used map[string]int64 // bytes in the last second
+		want map[string]float64
+	}{
+		{
+			name: "one light two heavy",
+			used: map[string]int64{"a": 50000, "b": 1000000, "c": 1000000},
+			want: map[string]float64{"a": 100000, "b": 450000, "c": 450000},
+		},
+		{
+			name: "all light",
+			used: map[string]int64{"a": 100000, "b": 100000},
+			want: map[string]float64{"a": 500000, "b": 500000},
+		},
+		{
+			name: "all heavy",
+			used: map[string]int64{"a": 2000000, "b": 3000000},
+			want: map[string]float64{"a": 500000, "b": 500000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShaper()
+			s.setLimit(8) // 1000000 Byte/s
+			now := time.Now().UnixNano()
+			for key, used := range tt.used {
+				s.share(key, now).used.Store(used)
+			}
+			s.rebalance(1)
+			var total float64
+			for key, want := range tt.want {
+				got := s.shares[key].rate.Load()
+				if math.Abs(got-want) > 1 {
+					t.Fatalf("rate of %s = %.0f, want %.0f", key, got, want)
+				}
+				total += got
+			}
+			if math.Abs(total-1000000) > 1 {
+				t.Fatalf("shares add up to %.0f, want the node rate", total)
+			}
+		})
+	}
+}
+
+func TestShaperSetLimitWithoutShares(t *testing.T) {
+	s := newShaper()
+	s.setLimit(8)
+	if s.waiter("a") == nil {
+		t.Fatal("limited node has no waiter")
+	}
+	s.setLimit(0)
+	if s.waiter("a") != nil {
+		t.Fatal("unlimited node has a waiter")
+	}
+}
+
+// A bucket lets one interval worth of bytes through, then charges the rest.
+func TestBucketTake(t *testing.T) {
+	var b bucket
+	now := time.Now().UnixNano()
+	if d := b.take(500, 1000, now); d != 0 {
+		t.Fatalf("burst within one interval waits %s", d)
+	}
+	if d := b.take(1000, 1000, now); d != time.Second {
+		t.Fatalf("debt of 1000 bytes at 1000 B/s waits %s, want 1s", d)
+	}
+	if d := b.take(1000, 1000, now+int64(2*time.Second)); d != 500*time.Millisecond {
+		t.Fatalf("take after the debt is paid waits %s, want 500ms", d)
+	}
+}
@@ -0,0 +1,198 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/conf"
+)
+
+const cacheDir = "/etc/v2node/cache"
+
+// nodeCache keeps the last node info and user list the panel returned,
+// so the node can come up with them while the panel is unreachable.
+type nodeCache struct {
+	path string
+	mu   sync.Mutex
+	data cacheData
+}
+
+type cacheData struct {
+	NodeInfo *panel.NodeInfo  `json:"node_info"`
+	NodeEtag string           `json:"node_etag"`
+	Users    []panel.UserInfo `json:"users"`
+	UserEtag string           `json:"user_etag"`
+}
+
+func cachePath(c *conf.NodeConfig) string {
+	return filepath.Join(cacheDir, nodeFileName(c)+".json")
+}
+
+// loadNodeCache reads the cache at path. A missing or broken file gives an empty cache.
+func loadNodeCache(path string) *nodeCache {
+	nc := &nodeCache{path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nc
+	}
+	if err := json.Unmarshal(b, &nc.data); err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"err":  err,
+		}).Warn("Ignore broken node cache")
+		nc.data = cacheData{}
+	}
+	return nc
+}
+
+func (nc *nodeCache) NodeInfo() *panel.NodeInfo {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.data.NodeInfo
+}
+
+func (nc *nodeCache) Users() []panel.UserInfo {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.data.Users
+}
+
+func (nc *nodeCache) ETags() (node, user string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.data.NodeEtag, nc.data.UserEtag
+}
+
+func (nc *nodeCache) SetNodeInfo(info *panel.NodeInfo, etag string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.data.NodeInfo = info
+	nc.data.NodeEtag = etag
+	return nc.save()
+}
+
+func (nc *nodeCache) SetUsers(users []panel.UserInfo, etag string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.data.Users = users
+	nc.data.UserEtag = etag
+	return nc.save()
+}
+
+func (nc *nodeCache) save() error {
+	b, err := json.Marshal(&nc.data)
+	if err != nil {
+		return fmt.Errorf("encode node cache error: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(nc.path), 0755); err != nil {
+		return fmt.Errorf("create cache dir error: %s", err)
+	}
+	tmp := nc.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write node cache error: %s", err)
+	}
+	if err := os.Rename(tmp, nc.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write node cache error: %s", err)
+	}
+	return nil
+}
+
+// restoreETags hands the cached ETags to the panel client, so an unchanged
+// panel answers 304 and the cached copy is used as is.
+func (c *Controller) restoreETags() {
+	p, ok := c.panel().(panel.ETagPanel)
+	if !ok {
+		return
+	}
+	node, user := c.cache.ETags()
+	if c.cache.NodeInfo() == nil {
+		node = ""
+	}
+	if c.cache.Users() == nil {
+		user = ""
+	}
+	p.SetETags(node, user)
+}
+
+func (c *Controller) etags() (node, user string) {
+	if p, ok := c.panel().(panel.ETagPanel); ok {
+		return p.ETags()
+	}
+	return "", ""
+}
+
+func (c *Controller) cacheNodeInfo(info *panel.NodeInfo) {
+	node, _ := c.etags()
+	if err := c.cache.SetNodeInfo(info, node); err != nil {
+		log.WithFields(log.Fields{
+			"tag": info.Tag,
+			"err": err,
+		}).Warn("Save node cache failed")
+	}
+}
+
+func (c *Controller) cacheUsers(users []panel.UserInfo) {
+	_, user := c.etags()
+	if err := c.cache.SetUsers(users, user); err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Warn("Save user cache failed")
+	}
+}
+
+// loadNodeInfo gets the node info from the panel, falling back to the
+// cached copy when the panel fails or reports it unchanged.
+func (c *Controller) loadNodeInfo() (*panel.NodeInfo, error) {
+	info, err := c.panel().GetNodeInfo()
+	if err == nil && info != nil {
+		c.applyPolicy(info)
+		c.cacheNodeInfo(info)
+		return info, nil
+	}
+	cached := c.cache.NodeInfo()
+	if cached == nil {
+		if err == nil {
+			err = errors.New("panel returned no node info")
+		}
+		return nil, err
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": cached.Tag,
+			"err": err,
+		}).Warn("Get node info failed, using cached node info")
+	}
+	c.applyPolicy(cached)
+	return cached, nil
+}
+
+// loadUserList gets the user list from the panel, falling back to the
+// cached copy when the panel fails or reports it unchanged. An empty list
+// is a valid answer and replaces the cache.
+func (c *Controller) loadUserList() ([]panel.UserInfo, error) {
+	users, err := c.panel().GetUserList()
+	if err == nil && users != nil {
+		c.cacheUsers(users)
+		return users, nil
+	}
+	cached := c.cache.Users()
+	if cached == nil {
+		return users, err
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Warn("Get user list failed, using cached user list")
+	}
+	return cached, nil
+}
@@ -115,3 +115,20 @@ func generateSelfSslCertificate(domain, certPath, keyPath string) error {
 	}
 	return nil
 }
+
+// certExpiryDays returns the days left until the certificate in certPath expires.
+func certExpiryDays(certPath string) (float64, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return 0, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return 0, fmt.Errorf("no pem data in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(cert.NotAfter).Hours() / 24, nil
+}
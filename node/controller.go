@@ -3,9 +3,12 @@ package node
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/common/metrics"
 	"github.com/wyx2685/v2node/common/task"
 	"github.com/wyx2685/v2node/conf"
 	"github.com/wyx2685/v2node/core"
@@ -13,60 +16,97 @@ import (
 )
 
 type Controller struct {
-	server                  *core.V2Core
-	apiClient               *panel.Client
-	tag                     string
-	limiter                 *limiter.Limiter
-	userList                []panel.UserInfo
-	aliveMap                map[int]int
-	conf                    *conf.NodeConfig
-	info                    *panel.NodeInfo
-	nodeInfoMonitorPeriodic *task.Task
-	userReportPeriodic      *task.Task
-	renewCertPeriodic       *task.Task
+	server                    *core.V2Core
+	apiClient                 panel.Panel
+	tag                       string
+	limiter                   *limiter.Limiter
+	userList                  []panel.UserInfo
+	aliveMap                  map[int]int
+	conf                      *conf.NodeConfig
+	info                      *panel.NodeInfo
+	nodeInfoMonitorPeriodic   *task.Task
+	userReportPeriodic        *task.Task
+	renewCertPeriodic         *task.Task
+	dynamicSpeedLimitPeriodic *task.Task
+	deviceRefreshPeriodic     *task.Task
+	journal                   *trafficJournal
+	usage                     *usage
+	cache                     *nodeCache
+	reportFailures            int
+	reportSkip                int
+	pullLock                  sync.Mutex
+	pushLock                  sync.Mutex
+	statusLock                sync.Mutex
+	stateLock                 sync.RWMutex // guards tag, info and apiClient for other goroutines
+	running                   bool
+	startErr                  error
+	addedLimiter              bool // what a failed Start has to undo
+	addedInbound              bool
+	drained                   bool // the inbound is kept open by stopAccepting
+	stop                      chan struct{}
+	stopOnce                  sync.Once
 }
 
 // NewController return a Node controller with default parameters.
-func NewController(api *panel.Client, conf *conf.NodeConfig, info *panel.NodeInfo) *Controller {
+func NewController(api panel.Panel, conf *conf.NodeConfig, info *panel.NodeInfo) *Controller {
 	controller := &Controller{
 		apiClient: api,
 		info:      info,
 		conf:      conf,
+		cache:     loadNodeCache(cachePath(conf)),
+		usage:     newUsage(),
+		stop:      make(chan struct{}),
+	}
+	if api != nil {
+		controller.restoreETags()
 	}
 	return controller
 }
 
 // Start implement the Start() function of the service interface
-func (c *Controller) Start(x *core.V2Core) error {
+func (c *Controller) Start(x *core.V2Core) (err error) {
 	// Init Core
 	c.server = x
-	var err error
-	// First fetch Node Info
-	node := c.info
-	if node == nil {
-		c.info, err = c.apiClient.GetNodeInfo()
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("get node info error: %s", err)
+			c.abortStart()
 		}
-		node = c.info
+		c.setStatus(err == nil, err)
+	}()
+	// First fetch Node Info
+	if err = c.prepare(); err != nil {
+		return err
 	}
+	node := c.info
+	c.setTag(node.Tag)
 	// Update user
-	c.userList, err = c.apiClient.GetUserList()
+	c.userList, err = c.loadUserList()
 	if err != nil {
 		return fmt.Errorf("get user list error: %s", err)
 	}
 	if len(c.userList) == 0 {
 		return errors.New("add users error: not have any user")
 	}
-	c.aliveMap, err = c.apiClient.GetUserAlive()
+	c.aliveMap, err = c.panel().GetUserAlive()
 	if err != nil {
 		return fmt.Errorf("failed to get user alive list: %s", err)
 	}
-	c.tag = node.Tag
 
+	// replay traffic left over from the last run
+	c.journal, err = openTrafficJournal(journalPath(c.conf))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Error("Open traffic journal failed, pending traffic is kept in memory only")
+	}
+	// the limiter of a tag exists while a node owns it
+	if _, err := limiter.GetLimiter(c.tag); err == nil {
+		return fmt.Errorf("tag %s is used by another node", c.tag)
+	}
 	// add limiter
-	l := limiter.AddLimiter(c.tag, c.userList, c.aliveMap)
-	c.limiter = l
+	c.addLimiter()
+	c.addedLimiter = true
 	if node.Security == panel.Tls {
 		err = c.requestCert()
 		if err != nil {
@@ -78,6 +118,7 @@ func (c *Controller) Start(x *core.V2Core) error {
 	if err != nil {
 		return fmt.Errorf("add new node error: %s", err)
 	}
+	c.addedInbound = true
 	added, err := c.server.AddUsers(&core.AddUsersParams{
 		Tag:      c.tag,
 		Users:    c.userList,
@@ -87,14 +128,174 @@ func (c *Controller) Start(x *core.V2Core) error {
 		return fmt.Errorf("add users error: %s", err)
 	}
 	log.WithField("tag", c.tag).Infof("Added %d new users", added)
-	c.info = node
+	c.setInfo(node)
 	c.startTasks(node)
+	go c.watchPanel()
+	c.registerMetrics()
 	return nil
 }
 
+// prepare creates the panel api and fetches the node info, if not done yet.
+func (c *Controller) prepare() error {
+	if c.panel() == nil {
+		p, err := panel.New(c.conf)
+		if err != nil {
+			return fmt.Errorf("create panel api error: %s", err)
+		}
+		c.stateLock.Lock()
+		c.apiClient = p
+		c.stateLock.Unlock()
+		c.restoreETags()
+	}
+	if c.info == nil {
+		info, err := c.loadNodeInfo()
+		if err != nil {
+			return fmt.Errorf("get node info error: %s", err)
+		}
+		c.setInfo(info)
+	}
+	return nil
+}
+
+// applyPolicy sets the core policy of info from the panel base config,
+// overridden by the local node config. A handshake timeout is dropped, see
+// conf.PolicyConfig.
+func (c *Controller) applyPolicy(info *panel.NodeInfo) {
+	var p conf.PolicyConfig
+	if b := info.Common.BaseConfig; b != nil {
+		p = conf.PolicyConfig{
+			Handshake:    b.Handshake,
+			ConnIdle:     b.ConnIdle,
+			UplinkOnly:   b.UplinkOnly,
+			DownlinkOnly: b.DownlinkOnly,
+			BufferSize:   b.BufferSize,
+		}
+	}
+	p = p.Merge(c.conf.PolicyConfig)
+	if c.conf.PolicyConfig.Handshake != nil {
+		log.WithFields(log.Fields{
+			"api_host": c.conf.APIHost,
+			"node_id":  c.conf.NodeID,
+		}).Warn("Handshake in the node Policy has no effect, set it in the global Policy")
+	} else if p.Handshake != nil {
+		log.WithField("node_id", c.conf.NodeID).Debug("Ignore handshake of the panel base config")
+	}
+	p.Handshake = nil
+	info.Policy = p
+}
+
+// addLimiter creates the limiter for the current tag and users.
+func (c *Controller) addLimiter() {
+	c.limiter = limiter.AddLimiter(c.tag, c.userList, c.aliveMap)
+	c.limiter.Panel = c.conf.APIHost
+	c.limiter.SpeedLimitUp = c.conf.SpeedLimitUp
+	c.limiter.SpeedLimitDown = c.conf.SpeedLimitDown
+	c.limiter.ConnLimit = c.conf.ConnLimit
+	c.limiter.SetNodeSpeedLimit(c.nodeSpeedLimit())
+	c.limiter.SetAuditRules(c.info.Common.AuditRules)
+	c.limiter.SetUnreported(c.unreportedTraffic())
+	c.limiter.UpdateQuota(c.tag, c.userList)
+}
+
+// unreportedTraffic returns a function giving what this node used that the
+// panel has not counted yet, by uid, the limiter takes it off the quotas.
+func (c *Controller) unreportedTraffic() func() map[int]int64 {
+	journal, server, tag := c.journal, c.server, c.tag
+	return func() map[int]int64 {
+		unreported := make(map[int]int64)
+		if journal != nil {
+			for _, t := range journal.Pending() {
+				unreported[t.UID] += t.Upload + t.Download
+			}
+		}
+		for _, t := range server.PeekUserTraffic(tag) {
+			unreported[t.UID] += t.Upload + t.Download
+		}
+		return unreported
+	}
+}
+
+// nodeSpeedLimit returns the total rate of the node, the local config
+// takes precedence over the panel.
+func (c *Controller) nodeSpeedLimit() int {
+	if c.conf.NodeSpeedLimit > 0 || c.info.Common.BaseConfig == nil {
+		return c.conf.NodeSpeedLimit
+	}
+	return c.info.Common.BaseConfig.NodeSpeedLimit
+}
+
+// abortStart undoes what a failed Start added so it can be retried, leaving
+// alone a node that holds the same tag.
+func (c *Controller) abortStart() {
+	if c.journal != nil {
+		c.journal.Close()
+		c.journal = nil
+	}
+	if c.addedLimiter {
+		limiter.DeleteLimiter(c.tag)
+		c.addedLimiter = false
+	}
+	c.limiter = nil
+	if c.addedInbound {
+		_ = c.server.DelNode(c.tag)
+		c.addedInbound = false
+	}
+}
+
+func (c *Controller) setStatus(running bool, err error) {
+	c.statusLock.Lock()
+	c.running = running
+	c.startErr = err
+	c.statusLock.Unlock()
+	up := 0.0
+	if running {
+		up = 1
+	}
+	metrics.NodeUp.Set(up, c.conf.APIHost, strconv.Itoa(c.conf.NodeID))
+}
+
+// Status reports whether the node is running, and if not, why it failed to start.
+func (c *Controller) Status() (bool, error) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.running, c.startErr
+}
+
+func (c *Controller) Running() bool {
+	running, _ := c.Status()
+	return running
+}
+
+// halt stops retrying a node that failed to start.
+func (c *Controller) halt() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	if w, ok := c.panel().(panel.WatchPanel); ok {
+		w.Close()
+	}
+	metrics.NodeUp.Delete(c.conf.APIHost, strconv.Itoa(c.conf.NodeID))
+}
+
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	c.halt()
+	if !c.Running() {
+		return nil
+	}
 	limiter.DeleteLimiter(c.tag)
+	c.unregisterMetrics()
+	c.stopTasks()
+	if c.journal != nil {
+		c.flushTraffic()
+		c.journal.Close()
+	}
+	err := c.server.DelNode(c.tag)
+	if err != nil {
+		return fmt.Errorf("del node error: %s", err)
+	}
+	return nil
+}
+
+func (c *Controller) stopTasks() {
 	if c.nodeInfoMonitorPeriodic != nil {
 		c.nodeInfoMonitorPeriodic.Close()
 	}
@@ -104,9 +305,152 @@ func (c *Controller) Close() error {
 	if c.renewCertPeriodic != nil {
 		c.renewCertPeriodic.Close()
 	}
-	err := c.server.DelNode(c.tag)
-	if err != nil {
+	if c.dynamicSpeedLimitPeriodic != nil {
+		c.dynamicSpeedLimitPeriodic.Close()
+	}
+	if c.deviceRefreshPeriodic != nil {
+		c.deviceRefreshPeriodic.Close()
+	}
+}
+
+// stopAccepting stops the periodic tasks and new connections, leaving the
+// links already dispatched running.
+func (c *Controller) stopAccepting() error {
+	c.halt()
+	if !c.Running() {
+		return nil
+	}
+	c.stopTasks()
+	if holdsSessions(c.info) {
+		c.server.DrainNode(c.tag)
+		c.drained = true
+		return nil
+	}
+	if err := c.server.DelNode(c.tag); err != nil {
 		return fmt.Errorf("del node error: %s", err)
 	}
 	return nil
 }
+
+// finish pushes the final reports and releases the controller after stopAccepting.
+func (c *Controller) finish() {
+	if !c.Running() {
+		return
+	}
+	if c.journal != nil {
+		c.finalReport()
+		c.journal.Close()
+	}
+	limiter.DeleteLimiter(c.tag)
+	c.unregisterMetrics()
+	if c.drained {
+		if err := c.server.DelNode(c.tag); err != nil {
+			log.WithField("tag", c.tag).Errorf("del node error: %v", err)
+		}
+	}
+}
+
+// holdsSessions reports whether the inbound of info keeps sessions that end
+// when it is removed: the QUIC servers and the UDP side of shadowsocks.
+func holdsSessions(info *panel.NodeInfo) bool {
+	switch info.Type {
+	case "hysteria2", "tuic", "shadowsocks":
+		return true
+	}
+	return false
+}
+
+// registerMetrics registers the collector refreshing the gauges of this node
+// before a scrape. The collector runs on the scrape goroutine, so it works on
+// a copy of what it needs and has to be registered again when that changes.
+func (c *Controller) registerMetrics() {
+	tag, journal := c.tag, c.journal
+	var certFile string
+	if c.info.Security == panel.Tls {
+		certFile = c.info.Common.CertInfo.CertFile
+	}
+	metrics.RegisterCollector(tag, func() {
+		if journal != nil {
+			metrics.PendingTrafficBytes.Set(float64(journal.PendingBytes()), tag)
+		}
+		if certFile == "" {
+			return
+		}
+		if days, err := certExpiryDays(certFile); err == nil {
+			metrics.CertExpiryDays.Set(days, tag)
+		}
+	})
+}
+
+func (c *Controller) unregisterMetrics() {
+	metrics.UnregisterCollector(c.tag)
+	metrics.PendingTrafficBytes.Delete(c.tag)
+	metrics.CertExpiryDays.Delete(c.tag)
+}
+
+// Tag returns the inbound tag of the node, it is safe to call from any goroutine.
+func (c *Controller) Tag() string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.tag
+}
+
+// Info returns the node info in use, it is safe to call from any goroutine.
+func (c *Controller) Info() *panel.NodeInfo {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.info
+}
+
+// setTag and setInfo publish a new tag or info to the readers of Tag and
+// Info. The controller's own code reads the fields directly.
+func (c *Controller) setTag(tag string) {
+	c.stateLock.Lock()
+	c.tag = tag
+	c.stateLock.Unlock()
+}
+
+func (c *Controller) setInfo(info *panel.NodeInfo) {
+	c.stateLock.Lock()
+	c.info = info
+	c.stateLock.Unlock()
+}
+
+// panel returns the panel client, reloadTask may replace it at any time.
+func (c *Controller) panel() panel.Panel {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.apiClient
+}
+
+func (c *Controller) Config() *conf.NodeConfig {
+	return c.conf
+}
+
+// OnlineUsers returns the devices seen on this node since the last report.
+func (c *Controller) OnlineUsers() []panel.OnlineUser {
+	if c.limiter == nil {
+		return nil
+	}
+	return c.limiter.OnlineDevices()
+}
+
+// Throttled returns the users held by a dynamic speed limit.
+func (c *Controller) Throttled() []limiter.ThrottledUser {
+	if c.limiter == nil {
+		return nil
+	}
+	return c.limiter.Throttled()
+}
+
+// Sync runs a pull and a push cycle right away, ignoring any report backoff.
+func (c *Controller) Sync() {
+	if !c.Running() {
+		return
+	}
+	_ = c.nodeInfoMonitor()
+	c.pushLock.Lock()
+	c.reportSkip = 0
+	c.pushLock.Unlock()
+	_ = c.reportUserTrafficTask()
+}
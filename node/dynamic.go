@@ -0,0 +1,136 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	panel "github.com/wyx2685/v2node/api/v2board"
+)
+
+const dynamicSpeedLimitInterval = time.Minute
+
+// usage keeps the traffic of each user over time for the dynamic speed limit rules.
+type usage struct {
+	mu      sync.Mutex
+	totals  map[int]int64 // taken from the core counters since start
+	history map[int][]usageSample
+}
+
+type usageSample struct {
+	at    time.Time
+	total int64
+}
+
+func newUsage() *usage {
+	return &usage{
+		totals:  make(map[int]int64),
+		history: make(map[int][]usageSample),
+	}
+}
+
+// takeTraffic takes the user traffic of at least min bytes out of the core
+// counters, keeping the running totals of the users in step when there are
+// dynamic speed limit rules.
+func (c *Controller) takeTraffic(min int) []panel.UserTraffic {
+	c.usage.mu.Lock()
+	defer c.usage.mu.Unlock()
+	userTraffic, _ := c.server.GetUserTrafficSlice(c.tag, min)
+	if len(c.conf.DynamicSpeedLimit) == 0 {
+		return userTraffic
+	}
+	for i := range userTraffic {
+		c.usage.totals[userTraffic[i].UID] += userTraffic[i].Upload + userTraffic[i].Download
+	}
+	return userTraffic
+}
+
+// dynamicSpeedLimitTask throttles the users whose traffic within the period
+// of a rule went over its threshold. Links already open are closed so the
+// clients reconnect under the new limit.
+func (c *Controller) dynamicSpeedLimitTask() error {
+	rules := c.conf.DynamicSpeedLimit
+	if len(rules) == 0 {
+		return nil
+	}
+	now := time.Now()
+	c.pullLock.Lock()
+	uuids := make(map[int]string, len(c.userList))
+	for i := range c.userList {
+		uuids[c.userList[i].Id] = c.userList[i].Uuid
+	}
+	c.pullLock.Unlock()
+
+	c.usage.mu.Lock()
+	// forget the users the panel no longer lists
+	for uid := range c.usage.totals {
+		if _, ok := uuids[uid]; !ok {
+			delete(c.usage.totals, uid)
+		}
+	}
+	current := make(map[int]int64, len(c.usage.totals))
+	for uid, total := range c.usage.totals {
+		current[uid] = total
+	}
+	for _, t := range c.server.PeekUserTraffic(c.tag) {
+		current[t.UID] += t.Upload + t.Download
+	}
+	c.usage.mu.Unlock()
+
+	window := time.Duration(0)
+	for _, r := range rules {
+		window = max(window, time.Duration(r.Period)*time.Minute)
+	}
+	throttled := make(map[int]struct{})
+	for _, t := range c.limiter.Throttled() {
+		throttled[t.UID] = struct{}{}
+	}
+	history := c.usage.history
+	for uid := range history {
+		if _, ok := uuids[uid]; !ok {
+			delete(history, uid)
+		}
+	}
+	for uid, total := range current {
+		if _, ok := uuids[uid]; !ok {
+			continue
+		}
+		samples := append(history[uid], usageSample{at: now, total: total})
+		for len(samples) > 1 && samples[0].at.Before(now.Add(-window-dynamicSpeedLimitInterval)) {
+			samples = samples[1:]
+		}
+		history[uid] = samples
+		uuid := uuids[uid]
+		if _, ok := throttled[uid]; ok {
+			continue
+		}
+		for _, r := range rules {
+			from := now.Add(-time.Duration(r.Period) * time.Minute)
+			base := samples[len(samples)-1]
+			for _, s := range samples {
+				if !s.at.Before(from) {
+					base = s
+					break
+				}
+			}
+			used := total - base.total
+			if used < r.Traffic*1000000 {
+				continue
+			}
+			until := now.Add(time.Duration(r.Duration) * time.Minute)
+			if err := c.limiter.UpdateDynamicSpeedLimit(c.tag, uuid, r.Limit, until); err != nil {
+				break
+			}
+			closed := c.server.KickUser(c.tag, uid, "")
+			log.WithFields(log.Fields{
+				"tag":   c.tag,
+				"uid":   uid,
+				"used":  used,
+				"limit": r.Limit,
+				"until": until.Format(time.RFC3339),
+			}).Warnf("User throttled by dynamic speed limit, %d links closed", closed)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package node
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/conf"
+)
+
+const (
+	journalDir = "/etc/v2node/traffic"
+	// maxJournalSize is the file size past which the journal is merged down
+	// to one line per user, it only grows while the panel is unreachable.
+	maxJournalSize = 16 << 20
+	// compactJournalSize is the file size past which a commit rewrites the
+	// journal, below it the commit is only appended.
+	compactJournalSize = 1 << 20
+	// maxPendingUsers caps the users held in the journal, the ones pending
+	// the longest are dropped beyond it.
+	maxPendingUsers = 200000
+)
+
+// trafficJournal is an append-only record of user traffic that has been
+// taken out of the core counters but not yet accepted by the panel.
+// Entries are only dropped after a successful push, and are replayed
+// on the next start.
+type trafficJournal struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	pending map[int]*panel.UserTraffic
+	since   map[int]time.Time // Key: Uid, value: when its traffic became pending
+}
+
+// journalEntry is one line of the journal, either traffic taken from the
+// core or, with Commit set, the traffic of one push the panel accepted.
+// A commit is a single line so a crash can't leave half of it.
+type journalEntry struct {
+	UID      int            `json:"uid,omitempty"`
+	Upload   int64          `json:"u,omitempty"`
+	Download int64          `json:"d,omitempty"`
+	Commit   []journalEntry `json:"commit,omitempty"`
+}
+
+// nodeFileName returns a file name unique to the panel and node id of c. A
+// file backend node is named after its node file, with a hash of the full
+// path as nodes in different directories may share the file name.
+func nodeFileName(c *conf.NodeConfig) string {
+	source := c.APIHost
+	if c.ApiType == "file" {
+		path, err := filepath.Abs(c.NodeFile)
+		if err != nil {
+			path = filepath.Clean(c.NodeFile)
+		}
+		sum := sha256.Sum256([]byte(path))
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		source = fmt.Sprintf("file-%s-%s", name, hex.EncodeToString(sum[:4]))
+	}
+	host := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimPrefix(strings.TrimPrefix(source, "https://"), "http://"))
+	return fmt.Sprintf("%s_%d", host, c.NodeID)
+}
+
+func journalPath(c *conf.NodeConfig) string {
+	return filepath.Join(journalDir, nodeFileName(c)+".journal")
+}
+
+// openTrafficJournal loads the pending traffic left in path and opens it for appending.
+// The returned journal is always usable; on error it only keeps traffic in memory.
+func openTrafficJournal(path string) (*trafficJournal, error) {
+	j := &trafficJournal{
+		path:    path,
+		pending: make(map[int]*panel.UserTraffic),
+		since:   make(map[int]time.Time),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return j, fmt.Errorf("create journal dir error: %s", err)
+	}
+	if err := j.replay(); err != nil {
+		return j, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return j, fmt.Errorf("open journal error: %s", err)
+	}
+	j.file = f
+	if info, err := f.Stat(); err == nil {
+		j.size = info.Size()
+	}
+	return j, nil
+}
+
+// replay merges the entries of the file, a torn last line from a crash is
+// cut off so the next append starts on a line of its own.
+func (j *trafficJournal) replay() error {
+	f, err := os.OpenFile(j.path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open journal error: %s", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read journal error: %s", err)
+		}
+		good += int64(len(line))
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		for _, c := range e.Commit {
+			j.merge(c.UID, -c.Upload, -c.Download)
+		}
+		if e.UID != 0 {
+			j.merge(e.UID, e.Upload, e.Download)
+		}
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > good {
+		if err := f.Truncate(good); err != nil {
+			return fmt.Errorf("truncate journal error: %s", err)
+		}
+	}
+	return nil
+}
+
+func (j *trafficJournal) merge(uid int, up, down int64) {
+	t, ok := j.pending[uid]
+	if !ok {
+		t = &panel.UserTraffic{UID: uid}
+		j.pending[uid] = t
+		j.since[uid] = time.Now()
+	}
+	t.Upload += up
+	t.Download += down
+	if t.Upload == 0 && t.Download == 0 {
+		delete(j.pending, uid)
+		delete(j.since, uid)
+	}
+}
+
+// trim drops the users pending the longest beyond maxPendingUsers,
+// the caller holds j.mu. It reports whether anything was dropped.
+func (j *trafficJournal) trim() bool {
+	over := len(j.pending) - maxPendingUsers
+	if over <= 0 {
+		return false
+	}
+	uids := make([]int, 0, len(j.pending))
+	for uid := range j.pending {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(a, b int) bool { return j.since[uids[a]].Before(j.since[uids[b]]) })
+	var dropped int64
+	for _, uid := range uids[:over] {
+		dropped += j.pending[uid].Upload + j.pending[uid].Download
+		delete(j.pending, uid)
+		delete(j.since, uid)
+	}
+	log.WithFields(log.Fields{
+		"path":  j.path,
+		"users": over,
+		"bytes": dropped,
+	}).Warn("Traffic journal full, dropped the oldest pending traffic")
+	return true
+}
+
+// Append records traffic taken from the core and syncs it to disk.
+func (j *trafficJournal) Append(traffic []panel.UserTraffic) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range traffic {
+		j.merge(traffic[i].UID, traffic[i].Upload, traffic[i].Download)
+	}
+	if j.file == nil {
+		j.trim()
+		return nil
+	}
+	if j.trim() || j.size > maxJournalSize {
+		log.WithFields(log.Fields{
+			"path": j.path,
+			"size": j.size,
+		}).Warn("Traffic journal too large, merging it")
+		// the merged pending traffic already holds what is being appended
+		return j.compact()
+	}
+	entries := make([]journalEntry, len(traffic))
+	for i := range traffic {
+		entries[i] = journalEntry{
+			UID:      traffic[i].UID,
+			Upload:   traffic[i].Upload,
+			Download: traffic[i].Download,
+		}
+	}
+	return j.write(entries)
+}
+
+// write appends entries to the file and syncs it, the caller holds j.mu.
+func (j *trafficJournal) write(entries []journalEntry) error {
+	w := bufio.NewWriter(j.file)
+	for i := range entries {
+		b, _ := json.Marshal(entries[i])
+		w.Write(b)
+		w.WriteByte('\n')
+		j.size += int64(len(b)) + 1
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write journal error: %s", err)
+	}
+	return j.file.Sync()
+}
+
+// Pending returns the traffic not yet accepted by the panel.
+func (j *trafficJournal) Pending() []panel.UserTraffic {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.pending) == 0 {
+		return nil
+	}
+	traffic := make([]panel.UserTraffic, 0, len(j.pending))
+	for _, t := range j.pending {
+		traffic = append(traffic, *t)
+	}
+	return traffic
+}
+
+// PendingBytes returns the total upload and download not yet accepted by the panel.
+func (j *trafficJournal) PendingBytes() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var total int64
+	for _, t := range j.pending {
+		total += t.Upload + t.Download
+	}
+	return total
+}
+
+// Commit drops traffic the panel has accepted. It is recorded with a commit
+// line, the file is only rewritten down to what is still pending when it is
+// empty or has grown past compactJournalSize.
+func (j *trafficJournal) Commit(pushed []panel.UserTraffic) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	commit := make([]journalEntry, len(pushed))
+	for i := range pushed {
+		j.merge(pushed[i].UID, -pushed[i].Upload, -pushed[i].Download)
+		commit[i] = journalEntry{
+			UID:      pushed[i].UID,
+			Upload:   pushed[i].Upload,
+			Download: pushed[i].Download,
+		}
+	}
+	if j.file == nil {
+		return nil
+	}
+	if len(j.pending) == 0 || j.size > compactJournalSize {
+		return j.compact()
+	}
+	return j.write([]journalEntry{{Commit: commit}})
+}
+
+// compact rewrites the file down to the pending traffic, the caller holds j.mu.
+func (j *trafficJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("compact journal error: %s", err)
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, t := range j.pending {
+		b, _ := json.Marshal(journalEntry{
+			UID:      t.UID,
+			Upload:   t.Upload,
+			Download: t.Download,
+		})
+		w.Write(b)
+		w.WriteByte('\n')
+		size += int64(len(b)) + 1
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact journal error: %s", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact journal error: %s", err)
+	}
+	j.file.Close()
+	j.size = size
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open journal error: %s", err)
+	}
+	return nil
+}
+
+func (j *trafficJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+)
+
+func sortedPending(j *trafficJournal) []panel.UserTraffic {
+	pending := j.Pending()
+	sort.Slice(pending, func(a, b int) bool { return pending[a].UID < pending[b].UID })
+	return pending
+}
+
+func samePending(t *testing.T, j *trafficJournal, want []panel.UserTraffic) {
+	t.Helper()
+	got := sortedPending(j)
+	if len(got) != len(want) {
+		t.Fatalf("pending = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pending = %+v, want %+v", got, want)
+		}
+	}
+}
+
+// Traffic appended before a crash, without a Close, must be pending after a restart.
+func TestJournalReplayAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.journal")
+	j, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append([]panel.UserTraffic{{UID: 1, Upload: 10, Download: 20}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append([]panel.UserTraffic{{UID: 1, Upload: 1, Download: 2}, {UID: 2, Upload: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	j2, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	samePending(t, j2, []panel.UserTraffic{{UID: 1, Upload: 11, Download: 22}, {UID: 2, Upload: 5}})
+}
+
+// A line torn by a crash is skipped, and traffic appended after it is not lost.
+func TestJournalTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.journal")
+	if err := os.WriteFile(path, []byte("{\"uid\":1,\"u\":10,\"d\":20}\n{\"uid\":2,\"u\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePending(t, j, []panel.UserTraffic{{UID: 1, Upload: 10, Download: 20}})
+	if err := j.Append([]panel.UserTraffic{{UID: 3, Download: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	j2, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	samePending(t, j2, []panel.UserTraffic{{UID: 1, Upload: 10, Download: 20}, {UID: 3, Download: 7}})
+}
+
+// Traffic the panel accepted must not be pushed again after a restart.
+func TestJournalCommitNotReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.journal")
+	j, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append([]panel.UserTraffic{{UID: 1, Upload: 10, Download: 20}, {UID: 2, Upload: 5, Download: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	before := j.size
+	if err := j.Commit([]panel.UserTraffic{{UID: 1, Upload: 10, Download: 20}}); err != nil {
+		t.Fatal(err)
+	}
+	if j.size <= before {
+		t.Fatal("small journal was rewritten on commit instead of appended to")
+	}
+	if err := j.Append([]panel.UserTraffic{{UID: 1, Upload: 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	j2, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePending(t, j2, []panel.UserTraffic{{UID: 1, Upload: 3}, {UID: 2, Upload: 5, Download: 5}})
+	if err := j2.Commit(j2.Pending()); err != nil {
+		t.Fatal(err)
+	}
+	j2.Close()
+
+	j3, err := openTrafficJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j3.Close()
+	samePending(t, j3, nil)
+	if j3.size != 0 {
+		t.Fatalf("journal with nothing pending is %d bytes", j3.size)
+	}
+}
@@ -1,60 +1,309 @@
 package node
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	panel "github.com/wyx2685/v2node/api/v2board"
 	"github.com/wyx2685/v2node/conf"
 	"github.com/wyx2685/v2node/core"
+	"github.com/wyx2685/v2node/limiter"
 )
 
 type Node struct {
+	access      sync.RWMutex
 	controllers []*Controller
 	NodeInfos   []*panel.NodeInfo
 }
 
+const (
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = 5 * time.Minute
+	// closeWait is how long Shutdown waits for the links it closed
+	closeWait = 5 * time.Second
+)
+
+// New prepares a controller for every node. A node whose info can't be
+// fetched is still returned, its start is retried in the background.
 func New(nodes []conf.NodeConfig) (*Node, error) {
 	n := &Node{
 		controllers: make([]*Controller, len(nodes)),
-		NodeInfos:   make([]*panel.NodeInfo, len(nodes)),
 	}
 	for i, node := range nodes {
-		p, err := panel.New(&node)
-		if err != nil {
-			return nil, err
-		}
-		info, err := p.GetNodeInfo()
-		if err != nil {
-			return nil, err
+		c := NewController(nil, &node, nil)
+		if err := c.prepare(); err != nil {
+			log.WithFields(log.Fields{
+				"api_host": node.APIHost,
+				"node_id":  node.NodeID,
+				"err":      err,
+			}).Error("Get node info failed")
 		}
-		n.controllers[i] = NewController(p, &node, info)
-		n.NodeInfos[i] = info
+		n.controllers[i] = c
 	}
+	n.updateInfos()
 	return n, nil
 }
 
+// Start starts every node. A node that fails is retried in the
+// background with backoff and does not affect the others.
 func (n *Node) Start(nodes []conf.NodeConfig, core *core.V2Core) error {
-	for i, node := range nodes {
-		err := n.controllers[i].Start(core)
-		if err != nil {
-			return fmt.Errorf("start node controller [%s-%d] error: %s",
-				node.APIHost,
-				node.NodeID,
-				err)
+	n.access.Lock()
+	defer n.access.Unlock()
+	for _, c := range n.controllers {
+		n.startController(c, core)
+	}
+	return nil
+}
+
+func (n *Node) startController(c *Controller, x *core.V2Core) {
+	if err := c.Start(x); err != nil {
+		log.WithFields(log.Fields{
+			"api_host": c.conf.APIHost,
+			"node_id":  c.conf.NodeID,
+			"err":      err,
+		}).Error("Start node failed, retrying in background")
+		go n.retry(c, x)
+	}
+}
+
+func (n *Node) retry(c *Controller, x *core.V2Core) {
+	delay := minRetryDelay
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(delay):
+		}
+		n.access.Lock()
+		err := n.retryStart(c, x)
+		n.access.Unlock()
+		if err == nil {
+			return
+		}
+		delay = min(delay*2, maxRetryDelay)
+		log.WithFields(log.Fields{
+			"api_host": c.conf.APIHost,
+			"node_id":  c.conf.NodeID,
+			"err":      err,
+		}).Warnf("Start node failed, next retry in %s", delay)
+	}
+}
+
+// retryStart makes one more attempt to start c, the caller holds n.access.
+func (n *Node) retryStart(c *Controller, x *core.V2Core) error {
+	select {
+	case <-c.stop:
+		return nil
+	default:
+	}
+	late := c.info == nil
+	if err := c.prepare(); err != nil {
+		c.setStatus(false, err)
+		return err
+	}
+	if late && (core.RoutesNeedReload(c.info) || !x.PolicyApplied(c.info)) {
+		// they were not part of the running core, restart it with them
+		log.WithField("tag", c.info.Tag).Info("Node has routes or policy for a new core, reload core")
+		select {
+		case x.ReloadCh <- struct{}{}:
+			return nil
+		default:
+			// keep the node late so the next attempt asks for the reload again
+			c.setInfo(nil)
+			return errors.New("send core reload signal failed")
 		}
 	}
+	if late {
+		if err := x.UpdateRoutes(nil, c.info); err != nil {
+			c.setInfo(nil)
+			return fmt.Errorf("add routes error: %s", err)
+		}
+	}
+	if err := c.Start(x); err != nil {
+		return err
+	}
+	n.updateInfos()
+	log.WithField("tag", c.tag).Info("Node started after retry")
 	return nil
 }
 
+// updateInfos collects the info of the nodes that have one, the caller holds n.access.
+func (n *Node) updateInfos() {
+	n.NodeInfos = make([]*panel.NodeInfo, 0, len(n.controllers))
+	for _, c := range n.controllers {
+		if info := c.Info(); info != nil {
+			n.NodeInfos = append(n.NodeInfos, info)
+		}
+	}
+}
+
+// Reload applies a new node list to the running core without touching the
+// nodes whose config is unchanged: removed nodes are closed and new ones
+// started, with their route rules swapped on the router. It reports false,
+// changing nothing, when a new node carries routes or its own policy that
+// need a full core restart to take effect, see core.RoutesNeedReload.
+func (n *Node) Reload(nodes []conf.NodeConfig, x *core.V2Core) (bool, error) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	kept := make([]bool, len(n.controllers))
+	var controllers []*Controller
+	var added []conf.NodeConfig
+	for i := range nodes {
+		found := false
+		for j, c := range n.controllers {
+			if !kept[j] && reflect.DeepEqual(*c.conf, nodes[i]) {
+				kept[j] = true
+				controllers = append(controllers, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, nodes[i])
+		}
+	}
+	newNodes, err := New(added)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range newNodes.NodeInfos {
+		if core.RoutesNeedReload(info) || !x.PolicyApplied(info) {
+			newNodes.Close()
+			return false, nil
+		}
+	}
+	// a new node on the tag of a closed one takes over its rules
+	closed := make(map[string]*panel.NodeInfo)
+	for j, c := range n.controllers {
+		if info := c.Info(); !kept[j] && info != nil {
+			closed[info.Tag] = info
+		}
+	}
+	for i, info := range newNodes.NodeInfos {
+		if err := x.UpdateRoutes(closed[info.Tag], info); err != nil {
+			// put back the rules already swapped, the running nodes stay as they were
+			for _, done := range newNodes.NodeInfos[:i+1] {
+				x.UpdateRoutes(done, closed[done.Tag])
+			}
+			log.WithFields(log.Fields{
+				"tag": info.Tag,
+				"err": err,
+			}).Error("Add node routes failed")
+			newNodes.Close()
+			return false, nil
+		}
+	}
+	for j, c := range n.controllers {
+		if kept[j] {
+			continue
+		}
+		if info := c.Info(); info != nil && !hasTag(newNodes.NodeInfos, info.Tag) {
+			if err := x.UpdateRoutes(info, nil); err != nil {
+				log.WithField("tag", c.tag).Errorf("remove routes failed: %v", err)
+			}
+		}
+		if err := c.Close(); err != nil {
+			log.WithField("tag", c.tag).Errorf("close controller failed: %v", err)
+		}
+	}
+	n.controllers = controllers
+	for _, c := range newNodes.controllers {
+		n.startController(c, x)
+		n.controllers = append(n.controllers, c)
+	}
+	n.updateInfos()
+	return true, nil
+}
+
+func hasTag(infos []*panel.NodeInfo, tag string) bool {
+	for _, info := range infos {
+		if info.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Kick disconnects the user uid on tag, or on every node if tag is empty,
+// without removing the user. If ip is set only the links from that device are
+// closed, and with ban > 0 the ip is also banned on the host for ban.
+func (n *Node) Kick(tag string, uid int, ip string, ban time.Duration) int {
+	closed := 0
+	for _, c := range n.Controllers() {
+		if !c.Running() || tag != "" && c.Tag() != tag {
+			continue
+		}
+		closed += c.server.KickUser(c.Tag(), uid, ip)
+	}
+	if ip != "" && ban > 0 {
+		if err := limiter.BanIP(ip, ban, fmt.Sprintf("kicked uid %d", uid), "admin"); err != nil {
+			log.WithField("err", err).Error("Ban ip failed")
+		}
+	}
+	if closed > 0 || ban > 0 {
+		log.WithFields(log.Fields{
+			"uid": uid,
+			"ip":  ip,
+			"ban": ban,
+		}).Infof("Kicked %d links", closed)
+	}
+	return closed
+}
+
+// Controllers returns the running node controllers.
+func (n *Node) Controllers() []*Controller {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	return append([]*Controller(nil), n.controllers...)
+}
+
 func (n *Node) Close() error {
-	var err error
+	n.access.Lock()
+	defer n.access.Unlock()
+	var errs []error
 	for _, c := range n.controllers {
-		if err = c.Close(); err != nil {
+		if err := c.Close(); err != nil {
 			log.Errorf("close controller failed: %v", err)
-			return err
+			errs = append(errs, err)
 		}
 	}
 	n.controllers = nil
-	return nil
+	return errors.Join(errs...)
+}
+
+// Shutdown stops accepting on every node, waits up to drain for the active
+// links to finish, then pushes the final traffic and online reports.
+// QUIC and UDP inbounds stay open until then for the sessions they hold.
+func (n *Node) Shutdown(x *core.V2Core, drain time.Duration) {
+	n.access.Lock()
+	controllers := n.controllers
+	for _, c := range controllers {
+		if err := c.stopAccepting(); err != nil {
+			log.WithField("tag", c.tag).Errorf("stop node failed: %v", err)
+		}
+	}
+	n.access.Unlock()
+	deadline := time.Now().Add(drain)
+	for x.ActiveLinks() > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if left := x.ActiveLinks(); left > 0 {
+		log.Warnf("Drain timeout, closing %d active links", left)
+		x.CloseAllLinks()
+		// let the closed links end so their traffic is in the final report
+		deadline = time.Now().Add(closeWait)
+		for x.ActiveLinks() > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	n.access.Lock()
+	defer n.access.Unlock()
+	for _, c := range controllers {
+		c.finish()
+	}
+	n.controllers = nil
 }
@@ -1,18 +1,23 @@
 package node
 
 import (
+	"fmt"
+	"reflect"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	panel "github.com/wyx2685/v2node/api/v2board"
 	"github.com/wyx2685/v2node/common/task"
 	vCore "github.com/wyx2685/v2node/core"
+	"github.com/wyx2685/v2node/limiter"
 )
 
 func (c *Controller) startTasks(node *panel.NodeInfo) {
 	// fetch node info task
 	c.nodeInfoMonitorPeriodic = &task.Task{
 		Name:     "nodeInfoMonitor",
+		APIHost:  c.conf.APIHost,
+		NodeID:   c.conf.NodeID,
 		Interval: node.PullInterval,
 		Execute:  c.nodeInfoMonitor,
 		Reload:   c.reloadTask,
@@ -20,6 +25,8 @@ func (c *Controller) startTasks(node *panel.NodeInfo) {
 	// fetch user list task
 	c.userReportPeriodic = &task.Task{
 		Name:     "reportUserTrafficTask",
+		APIHost:  c.conf.APIHost,
+		NodeID:   c.conf.NodeID,
 		Interval: node.PushInterval,
 		Execute:  c.reportUserTrafficTask,
 		Reload:   c.reloadTask,
@@ -29,12 +36,36 @@ func (c *Controller) startTasks(node *panel.NodeInfo) {
 	_ = c.nodeInfoMonitorPeriodic.Start(false)
 	log.WithField("tag", c.tag).Info("Start report node status")
 	_ = c.userReportPeriodic.Start(false)
+	// keep the devices of long-lived links from expiring
+	c.deviceRefreshPeriodic = &task.Task{
+		Name:     "deviceRefreshTask",
+		APIHost:  c.conf.APIHost,
+		NodeID:   c.conf.NodeID,
+		Interval: limiter.DeviceRefreshInterval,
+		Execute:  c.deviceRefreshTask,
+		Reload:   c.reloadTask,
+	}
+	_ = c.deviceRefreshPeriodic.Start(false)
+	if len(c.conf.DynamicSpeedLimit) > 0 {
+		c.dynamicSpeedLimitPeriodic = &task.Task{
+			Name:     "dynamicSpeedLimitTask",
+			APIHost:  c.conf.APIHost,
+			NodeID:   c.conf.NodeID,
+			Interval: dynamicSpeedLimitInterval,
+			Execute:  c.dynamicSpeedLimitTask,
+			Reload:   c.reloadTask,
+		}
+		log.WithField("tag", c.tag).Info("Start dynamic speed limit")
+		_ = c.dynamicSpeedLimitPeriodic.Start(false)
+	}
 	if node.Security == panel.Tls {
 		switch c.info.Common.CertInfo.CertMode {
 		case "none", "", "file", "self":
 		default:
 			c.renewCertPeriodic = &task.Task{
 				Name:     "renewCertTask",
+				APIHost:  c.conf.APIHost,
+				NodeID:   c.conf.NodeID,
 				Interval: time.Hour * 24,
 				Execute:  c.renewCertTask,
 				Reload:   c.reloadTask,
@@ -46,23 +77,165 @@ func (c *Controller) startTasks(node *panel.NodeInfo) {
 	}
 }
 
+// watchPanel pulls the node info as soon as the panel reports a change,
+// until the controller is closed.
+func (c *Controller) watchPanel() {
+	for {
+		p, ok := c.panel().(panel.WatchPanel)
+		if !ok {
+			return
+		}
+		select {
+		case <-c.stop:
+			p.Close()
+			return
+		case _, ok := <-p.Changed():
+			// closed when the client was replaced, pick up the new one
+			if ok {
+				c.nodeInfoMonitor()
+			}
+		}
+	}
+}
+
+func (c *Controller) deviceRefreshTask() error {
+	c.limiter.RefreshDevices(c.server.LinkIPs(c.tag))
+	return nil
+}
+
 func (c *Controller) reloadTask() {
 	newClient, err := panel.New(c.conf)
 	if err != nil {
 		log.Panic("Tasks reload failed")
 	}
+	c.stateLock.Lock()
+	old := c.apiClient
 	c.apiClient = newClient
-	c.nodeInfoMonitorPeriodic.Close()
-	c.userReportPeriodic.Close()
-	if c.renewCertPeriodic != nil {
-		c.renewCertPeriodic.Close()
+	c.stateLock.Unlock()
+	if w, ok := old.(panel.WatchPanel); ok {
+		w.Close()
 	}
+	c.stopTasks()
 	c.startTasks(c.info)
 }
 
+// updateNode applies new node info from the panel. Only this node's inbound is
+// rebuilt, other nodes and their connections are left alone. Route rules are
+// swapped on the running router, while DNS routes and policies are compiled
+// into the core's name servers and levels, so a change to either still
+// reloads the whole core, as does a new tag for a node with the geoip:cn block.
+func (c *Controller) updateNode(newN *panel.NodeInfo) error {
+	if vCore.DNSRoutesChanged(c.info, newN) || !c.server.PolicyApplied(newN) ||
+		newN.Tag != c.info.Tag && vCore.BlockCN(newN.Id) {
+		log.WithField("tag", c.tag).Info("Node dns routes, policy or blocked tag changed, reload core")
+		c.reloadCore()
+		return nil
+	}
+	if c.info.Tag != newN.Tag || !reflect.DeepEqual(c.info.Common.Routes, newN.Common.Routes) {
+		if err := c.server.UpdateRoutes(c.info, newN); err != nil {
+			log.WithFields(log.Fields{
+				"tag": c.tag,
+				"err": err,
+			}).Error("Update routes failed, reload core")
+			c.reloadCore()
+			return nil
+		}
+		log.WithField("tag", c.tag).Info("Node routes updated")
+	}
+	rebuild := inboundChanged(c.info, newN)
+	restart := rebuild ||
+		c.info.PushInterval != newN.PushInterval ||
+		c.info.PullInterval != newN.PullInterval
+	if rebuild {
+		c.flushTraffic()
+		if err := c.server.DelUsers(c.userList, c.tag, c.info); err != nil {
+			return c.rebuildFailed(fmt.Errorf("del users error: %s", err))
+		}
+		if err := c.server.DelNode(c.tag); err != nil {
+			return c.rebuildFailed(fmt.Errorf("del node error: %s", err))
+		}
+		if newN.Tag != c.tag {
+			limiter.DeleteLimiter(c.tag)
+			c.unregisterMetrics()
+			c.setTag(newN.Tag)
+			c.addLimiter()
+		}
+	}
+	c.setInfo(newN)
+	c.registerMetrics()
+	c.limiter.SetNodeSpeedLimit(c.nodeSpeedLimit())
+	c.limiter.SetAuditRules(newN.Common.AuditRules)
+	if rebuild {
+		if newN.Security == panel.Tls {
+			if err := c.requestCert(); err != nil {
+				return c.rebuildFailed(fmt.Errorf("request cert error: %s", err))
+			}
+		}
+		if err := c.server.AddNode(c.tag, newN); err != nil {
+			return c.rebuildFailed(fmt.Errorf("add new node error: %s", err))
+		}
+		added, err := c.server.AddUsers(&vCore.AddUsersParams{
+			Tag:      c.tag,
+			Users:    c.userList,
+			NodeInfo: newN,
+		})
+		if err != nil {
+			return c.rebuildFailed(fmt.Errorf("add users error: %s", err))
+		}
+		log.WithField("tag", c.tag).Infof("Inbound rebuilt with %d users", added)
+	}
+	if restart {
+		c.stopTasks()
+		c.startTasks(newN)
+	}
+	return nil
+}
+
+// rebuildFailed handles err from rebuilding the inbound in updateNode. The
+// node is left without its inbound or some of its users, and the panel won't
+// send the same info again, so the node is marked down and rebuilt by a core
+// reload.
+func (c *Controller) rebuildFailed(err error) error {
+	c.setStatus(false, err)
+	log.WithFields(log.Fields{
+		"tag": c.tag,
+		"err": err,
+	}).Error("Rebuild inbound failed, reload core")
+	c.reloadCore()
+	return err
+}
+
+// reloadCore asks for a restart of the whole core.
+func (c *Controller) reloadCore() {
+	// Non-blocking signal to avoid goroutine stuck when channel is full or nil
+	if c.server.ReloadCh == nil {
+		log.WithField("tag", c.tag).Error("Reload core failed, no reload channel")
+		return
+	}
+	select {
+	case c.server.ReloadCh <- struct{}{}:
+	default:
+	}
+}
+
+// inboundChanged reports whether the inbound built from old differs from
+// the one built from new. Routes, audit rules and base config are handled separately.
+func inboundChanged(old, new *panel.NodeInfo) bool {
+	if old.Type != new.Type || old.Security != new.Security || old.Tag != new.Tag {
+		return true
+	}
+	o, n := *old.Common, *new.Common
+	o.Routes, n.Routes = nil, nil
+	o.AuditRules, n.AuditRules = nil, nil
+	o.BaseConfig, n.BaseConfig = nil, nil
+	return !reflect.DeepEqual(o, n)
+}
+
 func (c *Controller) nodeInfoMonitor() (err error) {
+	c.pullLock.Lock()
+	defer c.pullLock.Unlock()
 	// get node info
-	newN, err := c.apiClient.GetNodeInfo()
+	newN, err := c.panel().GetNodeInfo()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tag": c.tag,
@@ -71,23 +244,28 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		return nil
 	}
 	if newN != nil {
+		c.applyPolicy(newN)
 		log.WithFields(log.Fields{
 			"tag": c.tag,
-		}).Error("Got new node info, reload")
-		// Non-blocking signal to avoid goroutine stuck when channel is full or nil
-		if c.server.ReloadCh != nil {
-			select {
-			case c.server.ReloadCh <- struct{}{}:
-			default:
-			}
-		} else {
-			log.Panic("Reload failed")
+		}).Info("Got new node info, reload")
+		if err := c.updateNode(newN); err != nil {
+			log.WithFields(log.Fields{
+				"tag": c.tag,
+				"err": err,
+			}).Error("Update node failed")
+			return nil
 		}
+		c.cacheNodeInfo(newN)
+	} else {
+		log.WithField("tag", c.tag).Debug("Node info no change")
+	}
+
+	if c.conf.PullBanList {
+		c.syncBanList()
 	}
-	log.WithField("tag", c.tag).Debug("Node info no change")
 
 	// get user info
-	newU, err := c.apiClient.GetUserList()
+	newU, err := c.panel().GetUserList()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tag": c.tag,
@@ -96,7 +274,7 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		return nil
 	}
 	// get user alive
-	newA, err := c.apiClient.GetUserAlive()
+	newA, err := c.panel().GetUserAlive()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tag": c.tag,
@@ -110,10 +288,11 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		c.limiter.AliveList = newA
 	}
 	// node no changed, check users
-	if len(newU) == 0 {
+	if newU == nil {
 		log.WithField("tag", c.tag).Debug("User list no change")
 		return nil
 	}
+	c.limiter.UpdateQuota(c.tag, newU)
 	deleted, added := compareUserList(c.userList, newU)
 	if len(deleted) > 0 {
 		// have deleted users
@@ -153,9 +332,38 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		}
 	}
 	c.userList = newU
+	c.cacheUsers(newU)
 	if len(added)+len(deleted) != 0 {
 		log.WithField("tag", c.tag).
 			Infof("%d user deleted, %d user added", len(deleted), len(added))
 	}
 	return nil
 }
+
+// syncBanList replaces the bans this node got from the panel with the current list.
+func (c *Controller) syncBanList() {
+	p, ok := c.panel().(panel.BanListPanel)
+	if !ok {
+		return
+	}
+	list, err := p.GetBanList()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Error("Get ban list failed")
+		return
+	}
+	if list == nil {
+		return
+	}
+	bans := make([]limiter.Ban, 0, len(list))
+	for _, b := range list {
+		bans = append(bans, limiter.Ban{
+			CIDR:   b.IP,
+			Until:  b.ExpireAt,
+			Reason: b.Reason,
+		})
+	}
+	limiter.SetSourceBans("panel:"+nodeFileName(c.conf), bans)
+}
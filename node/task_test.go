@@ -0,0 +1,66 @@
+package node
+
+import (
+	"net"
+	"testing"
+
+	panel "github.com/wyx2685/v2node/api/v2board"
+	"github.com/wyx2685/v2node/conf"
+	"github.com/wyx2685/v2node/core"
+	"github.com/wyx2685/v2node/limiter"
+)
+
+// An inbound that can't be built again after its old one was removed must
+// take the node down and reload the core, the panel won't resend the info.
+func TestUpdateNodeReloadsOnRebuildFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	x := core.New(conf.New())
+	x.ReloadCh = make(chan struct{}, 1)
+	if err := x.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	const tag = "vless-test"
+	old := &panel.NodeInfo{
+		Id:   1,
+		Type: "vless",
+		Tag:  tag,
+		Common: &panel.CommonNode{
+			ListenIP:   "127.0.0.1",
+			ServerPort: port,
+			Network:    "tcp",
+		},
+	}
+	if err := x.AddNode(tag, old); err != nil {
+		t.Fatal(err)
+	}
+	limiter.Init()
+	c := NewController(nil, &conf.NodeConfig{APIHost: "test", NodeID: 1}, old)
+	c.server = x
+	c.tag = tag
+	c.limiter = limiter.AddLimiter(tag, nil, map[int]int{})
+	defer limiter.DeleteLimiter(tag)
+	c.setStatus(true, nil)
+
+	newN := *old
+	common := *old.Common
+	common.Encryption = "unknown"
+	newN.Common = &common
+	if err := c.updateNode(&newN); err == nil {
+		t.Fatal("update with an inbound that can't be built succeeded")
+	}
+	if c.Running() {
+		t.Fatal("node without an inbound still reports running")
+	}
+	select {
+	case <-x.ReloadCh:
+	default:
+		t.Fatal("core reload not requested")
+	}
+}
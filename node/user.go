@@ -2,32 +2,55 @@ package node
 
 import (
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	panel "github.com/wyx2685/v2node/api/v2board"
 )
 
+const (
+	maxReportBatch   = 5000
+	maxReportBackoff = 10 * time.Minute
+)
+
 func (c *Controller) reportUserTrafficTask() (err error) {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
 	var reportmin = 0
 	var devicemin = 0
 	if c.info.Common.BaseConfig != nil {
 		reportmin = c.info.Common.BaseConfig.NodeReportMinTraffic
 		devicemin = c.info.Common.BaseConfig.DeviceOnlineMinTraffic
 	}
-	userTraffic, _ := c.server.GetUserTrafficSlice(c.tag, reportmin)
+	userTraffic := c.takeTraffic(reportmin)
 	if len(userTraffic) > 0 {
-		err = c.apiClient.ReportUserTraffic(userTraffic)
-		if err != nil {
+		if err = c.journal.Append(userTraffic); err != nil {
 			log.WithFields(log.Fields{
 				"tag": c.tag,
 				"err": err,
-			}).Info("Report user traffic failed")
+			}).Error("Write traffic journal failed")
+		}
+	}
+	// push everything not yet accepted by the panel, including earlier failures
+	if pending := c.journal.Pending(); len(pending) > 0 {
+		if c.reportSkip > 0 {
+			c.reportSkip--
+			log.WithField("tag", c.tag).Debugf("Backing off traffic report, %d bytes pending", c.journal.PendingBytes())
 		} else {
-			log.WithField("tag", c.tag).Infof("Report %d users traffic", len(userTraffic))
-			//log.WithField("tag", c.tag).Debugf("User traffic: %+v", userTraffic)
+			c.pushTraffic(pending)
 		}
 	}
 
+	c.reportOnlineUsers(userTraffic, devicemin)
+	c.reportAuditEvents()
+
+	userTraffic = nil
+	return nil
+}
+
+// reportOnlineUsers reports the devices seen since the last report,
+// skipping users whose traffic in userTraffic is below devicemin KB.
+func (c *Controller) reportOnlineUsers(userTraffic []panel.UserTraffic, devicemin int) {
 	if onlineDevice, err := c.limiter.GetOnlineDevice(); err != nil {
 		log.Print(err)
 	} else if len(*onlineDevice) > 0 {
@@ -49,7 +72,7 @@ func (c *Controller) reportUserTrafficTask() (err error) {
 			// json structure: { UID1:["ip1","ip2"],UID2:["ip3","ip4"] }
 			data[onlineuser.UID] = append(data[onlineuser.UID], onlineuser.IP)
 		}
-		if err = c.apiClient.ReportNodeOnlineUsers(&data); err != nil {
+		if err := c.panel().ReportNodeOnlineUsers(&data); err != nil {
 			log.WithFields(log.Fields{
 				"tag": c.tag,
 				"err": err,
@@ -60,19 +83,115 @@ func (c *Controller) reportUserTrafficTask() (err error) {
 		}
 	}
 
-	userTraffic = nil
-	return nil
+}
+
+// reportAuditEvents pushes the audit rule and block route hits since the last
+// report in batches of at most maxReportBatch. Events the panel did not take
+// are queued for the next report.
+func (c *Controller) reportAuditEvents() {
+	events := c.limiter.TakeAuditEvents()
+	if len(events) == 0 {
+		return
+	}
+	p, ok := c.panel().(panel.AuditPanel)
+	if !ok {
+		return
+	}
+	for len(events) > 0 {
+		batch := events[:min(len(events), maxReportBatch)]
+		if err := p.ReportAuditEvents(batch); err != nil {
+			log.WithFields(log.Fields{
+				"tag": c.tag,
+				"err": err,
+			}).Info("Report audit events failed")
+			c.limiter.RequeueAuditEvents(events)
+			return
+		}
+		events = events[len(batch):]
+		log.WithField("tag", c.tag).Infof("Report %d audit events", len(batch))
+	}
+}
+
+// pushTraffic reports pending traffic in batches of at most maxReportBatch users.
+// A failed batch stays in the journal and is merged into the next push; repeated
+// failures skip an exponentially growing number of push rounds.
+func (c *Controller) pushTraffic(pending []panel.UserTraffic) {
+	for len(pending) > 0 {
+		batch := pending[:min(len(pending), maxReportBatch)]
+		pending = pending[len(batch):]
+		if err := c.panel().ReportUserTraffic(batch); err != nil {
+			c.reportFailures++
+			c.reportSkip = min(1<<min(c.reportFailures-1, 8)-1, int(maxReportBackoff/max(c.info.PushInterval, time.Second)))
+			log.WithFields(log.Fields{
+				"tag":     c.tag,
+				"err":     err,
+				"pending": c.journal.PendingBytes(),
+				"retry":   c.reportSkip + 1,
+			}).Info("Report user traffic failed")
+			return
+		}
+		c.reportFailures = 0
+		log.WithField("tag", c.tag).Infof("Report %d users traffic", len(batch))
+		//log.WithField("tag", c.tag).Debugf("User traffic: %+v", batch)
+		if err := c.journal.Commit(batch); err != nil {
+			log.WithFields(log.Fields{
+				"tag": c.tag,
+				"err": err,
+			}).Error("Commit traffic journal failed")
+		}
+	}
+}
+
+// PendingTraffic returns the bytes taken from the core but not yet accepted by the panel.
+func (c *Controller) PendingTraffic() int64 {
+	if c.journal == nil {
+		return 0
+	}
+	return c.journal.PendingBytes()
+}
+
+// flushTraffic moves all traffic still held by the core into the journal,
+// so it survives a reload or shutdown and is pushed on the next start.
+func (c *Controller) flushTraffic() []panel.UserTraffic {
+	userTraffic := c.takeTraffic(0)
+	if len(userTraffic) == 0 {
+		return nil
+	}
+	if err := c.journal.Append(userTraffic); err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Error("Write traffic journal failed")
+	}
+	return userTraffic
+}
+
+// finalReport flushes the core counters and pushes the remaining traffic and
+// online users regardless of any report backoff.
+func (c *Controller) finalReport() {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	devicemin := 0
+	if c.info.Common.BaseConfig != nil {
+		devicemin = c.info.Common.BaseConfig.DeviceOnlineMinTraffic
+	}
+	userTraffic := c.flushTraffic()
+	if pending := c.journal.Pending(); len(pending) > 0 {
+		c.pushTraffic(pending)
+	}
+	c.reportOnlineUsers(userTraffic, devicemin)
+	c.reportAuditEvents()
 }
 
 func compareUserList(old, new []panel.UserInfo) (deleted, added []panel.UserInfo) {
 	oldMap := make(map[string]int)
 	for i, user := range old {
-		key := user.Uuid + strconv.Itoa(user.SpeedLimit)
+		key := userKey(&user)
 		oldMap[key] = i
 	}
 
 	for _, user := range new {
-		key := user.Uuid + strconv.Itoa(user.SpeedLimit)
+		key := userKey(&user)
 		if _, exists := oldMap[key]; !exists {
 			added = append(added, user)
 		} else {
@@ -86,3 +205,9 @@ func compareUserList(old, new []panel.UserInfo) (deleted, added []panel.UserInfo
 
 	return deleted, added
 }
+
+// userKey identifies a user together with the limits that need it re-added when changed.
+func userKey(u *panel.UserInfo) string {
+	return u.Uuid + strconv.Itoa(u.SpeedLimit) + "/" + strconv.Itoa(u.SpeedLimitUp) + "/" + strconv.Itoa(u.SpeedLimitDown) +
+		"/" + strconv.Itoa(u.ConnLimit) + "/" + strconv.Itoa(u.DeviceLimit)
+}